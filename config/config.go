@@ -20,13 +20,54 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
 )
 
+// Values for Secret.Format.
+const (
+	FormatDotenv     = "dotenv"
+	FormatJSON       = "json"
+	FormatYAML       = "yaml"
+	FormatProperties = "properties"
+)
+
+// Values for Secret.KeyCase.
+const (
+	KeyCaseUpperSnake = "upper-snake"
+	KeyCaseLowerSnake = "lower-snake"
+)
+
+// Values for the "auth" attribute and MountConfig.Auth.
+const (
+	// AuthProvider uses the Connect token of the provider DaemonSet.
+	AuthProvider = "provider"
+	// AuthNodePublishSecretRef uses the Connect token in the Kubernetes
+	// Secret referenced by the nodePublishSecretRef of the volume.
+	AuthNodePublishSecretRef = "nodePublishSecretRef"
+)
+
+// profilePattern matches valid Connect profile names.
+var profilePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Keys of the Kubernetes Secret referenced by nodePublishSecretRef.
+const (
+	secretKeyToken = "token"
+	secretKeyURL   = "url"
+)
+
+// Values for Secret.MatchBy.
+const (
+	MatchByID    = "id"
+	MatchByTitle = "title"
+)
+
 const (
 	attributePodName            = "csi.storage.k8s.io/pod.name"
 	attributePodNamespace       = "csi.storage.k8s.io/pod.namespace"
@@ -34,12 +75,14 @@ const (
 	attributeServiceAccountName = "csi.storage.k8s.io/serviceAccount.name"
 )
 
-// Secret holds the parameters of the SecretProviderClass CRD. Links the 1password
-// secret resource name to a path in the filesystem.  Completely unchanged from GCP
-// provider, could possibly be changed later
+// Secret holds the parameters of a secret of the SecretProviderClass CRD. Links
+// a 1Password item, field or file attachment to a path in the filesystem, either
+// as raw content, expanded into one file per field, rendered in a Format or
+// rendered from a Template.
 type Secret struct {
-	// ResourceName refers to a Secret in OnePassword in the format
-	// vaults/*/secrets/*[/optionalField].
+	// ResourceName refers to a Secret in OnePassword, either as a secret
+	// reference op://vault/item[/section]/field[?attribute=...] or in the
+	// format vaults/*/secrets/*[/optionalField].
 	ResourceName string `json:"resourceName" yaml:"resourceName"`
 
 	// FileName is where the contents of the secret are to be written.
@@ -51,6 +94,77 @@ type Secret struct {
 	// Mode is the optional file mode for the file containing the secret. Must be
 	// an octal value between 0000 and 0777 or a decimal value between 0 and 511
 	Mode *int32 `json:"mode,omitempty" yaml:"mode,omitempty"`
+
+	// MatchBy controls how the vault and item of ResourceName are looked up.
+	// Either "id", "title" or empty to treat values that look like 1Password
+	// IDs as IDs and everything else as titles.
+	MatchBy string `json:"matchBy,omitempty" yaml:"matchBy,omitempty"`
+
+	// Section optionally restricts the field lookup to the item section with
+	// this label or ID. Overrides the section of ResourceName.
+	Section string `json:"section,omitempty" yaml:"section,omitempty"`
+
+	// Field optionally selects the field with this label or ID. Overrides the
+	// field of ResourceName.
+	Field string `json:"field,omitempty" yaml:"field,omitempty"`
+
+	// File optionally selects a file attachment of the item by name or ID.
+	// The raw file content is written.
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+
+	// Expand writes one file per field of the item into the directory at
+	// Path instead of a single file. File names are the sanitized field
+	// labels.
+	Expand bool `json:"expand,omitempty" yaml:"expand,omitempty"`
+
+	// SectionDirs places the fields of item sections into subdirectories
+	// named after the section when Expand is set.
+	SectionDirs bool `json:"sectionDirs,omitempty" yaml:"sectionDirs,omitempty"`
+
+	// Format renders the fields of the item into a single file as "dotenv",
+	// "json", "yaml" or "properties", keyed by field label.
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+
+	// KeyCase normalizes the keys of a formatted item, either "upper-snake"
+	// (UPPER_SNAKE_CASE) or "lower-snake" (lower_snake_case). Empty keeps
+	// the field labels.
+	KeyCase string `json:"keyCase,omitempty" yaml:"keyCase,omitempty"`
+
+	// SectionPrefix prefixes the keys of a formatted item with the section
+	// label of fields that belong to a section.
+	SectionPrefix bool `json:"sectionPrefix,omitempty" yaml:"sectionPrefix,omitempty"`
+
+	// Include limits the fields of an expanded or formatted item to those
+	// matching the filter.
+	Include *FieldFilter `json:"include,omitempty" yaml:"include,omitempty"`
+
+	// Exclude drops the fields matching the filter from an expanded or
+	// formatted item.
+	Exclude *FieldFilter `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+
+	// Template is a Go text/template rendered into the file at Path instead
+	// of mounting ResourceName. The values of Refs are available by name,
+	// e.g. {{ .password }}.
+	Template string `json:"template,omitempty" yaml:"template,omitempty"`
+
+	// Refs maps the names used in Template to secret references of fields
+	// or file attachments, possibly in different vaults and items.
+	Refs map[string]string `json:"refs,omitempty" yaml:"refs,omitempty"`
+
+	// Reference is the parsed form of ResourceName, populated by Parse.
+	Reference *Reference `json:"-" yaml:"-"`
+
+	// TemplateRefs are the parsed forms of Refs, populated by Parse.
+	TemplateRefs map[string]*Reference `json:"-" yaml:"-"`
+}
+
+// FieldFilter selects item fields by type or by label. A field matches if
+// either its type or its label (or ID) is listed.
+type FieldFilter struct {
+	// Types are 1Password field types such as CONCEALED or STRING.
+	Types []string `json:"types,omitempty" yaml:"types,omitempty"`
+	// Labels are field labels or IDs.
+	Labels []string `json:"labels,omitempty" yaml:"labels,omitempty"`
 }
 
 // PodInfo includes details about the pod that is receiving the mount event.
@@ -67,21 +181,18 @@ type MountConfig struct {
 	PodInfo     *PodInfo
 	TargetPath  string
 	Permissions os.FileMode
-	// AuthPodADC identifies whether Workload Identity should be used for
-	// authentication. This is the of the pod for volume mount (default)
-	AuthPodADC bool
-	// AuthProviderADC identifies whether the Application Default Credentials of the
-	// GCP Provider DaemonSet should be used for authentication.
-	// https://cloud.google.com/docs/authentication/production#automatically
-	AuthProviderADC bool
-	// AuthNodePublishSecret identifies whether the a K8s Secret provided on the
-	// NodePublish call should be used for authentication.
-	// https://kubernetes-csi.github.io/docs/secrets-and-credentials-storage-class.html
-	//
-	// If set then AuthKubeSecret will contain the json representation of the
-	// Google credential (parseable by google.CredentialsFromJSON).
-	AuthNodePublishSecret bool
-	AuthKubeSecret        []byte
+	// Auth selects the Connect credentials used for the mount, AuthProvider
+	// or AuthNodePublishSecretRef.
+	Auth string
+	// ConnectToken is the Connect token from the nodePublishSecretRef of the
+	// volume when Auth is AuthNodePublishSecretRef.
+	ConnectToken string
+	// ConnectURL optionally overrides the provider's Connect server URL when
+	// Auth is AuthNodePublishSecretRef.
+	ConnectURL string
+	// Profile is the Connect profile of the provider config file selected by
+	// the "connect" attribute, empty for the default profile.
+	Profile string
 }
 
 // MountParams hold unparsed arguments from the CSI Driver from the mount event.
@@ -114,72 +225,212 @@ func Parse(in *MountParams) (*MountConfig, error) {
 		return nil, fmt.Errorf("failed to unmarshal attributes: %v", err)
 	}
 
-	out.PodInfo = &PodInfo{
-		Namespace:      attrib[attributePodNamespace],
-		Name:           attrib[attributePodName],
-		UID:            types.UID(attrib[attributePodUID]),
-		ServiceAccount: attrib[attributeServiceAccountName],
-	}
+	out.PodInfo = podInfo(attrib)
 
-	podInfo := klog.ObjectRef{Namespace: out.PodInfo.Namespace, Name: out.PodInfo.Name}
+	podRef := klog.ObjectRef{Namespace: out.PodInfo.Namespace, Name: out.PodInfo.Name}
 
 	// The secrets here are the relevant CSI driver (k8s) secrets. See
 	// https://kubernetes-csi.github.io/docs/secrets-and-credentials-storage-class.html
 	if err := json.Unmarshal([]byte(in.KubeSecrets), &secret); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal secrets: %v", err)
 	}
-	if _, ok := secret["key.json"]; ok {
-		out.AuthNodePublishSecret = true
-		out.AuthKubeSecret = []byte(secret["key.json"])
+	out.Profile = attrib["connect"]
+	if out.Profile != "" && !profilePattern.MatchString(out.Profile) {
+		return nil, fmt.Errorf("invalid connect profile name %q", out.Profile)
+	}
+
+	if err := parseAuth(out, attrib["auth"], secret); err != nil {
+		klog.InfoS("invalid auth configuration", "pod", podRef, "err", err)
+		return nil, err
 	}
+	klog.V(3).InfoS("parsed auth", "auth", out.Auth, "pod", podRef)
 
-	switch attrib["auth"] {
-	case "provider-adc":
-		if out.AuthNodePublishSecret {
-			klog.InfoS("attempting to set both nodePublishSecretRef and provider-adc auth. For details consult https://github.com/GoogleCloudPlatform/secrets-store-csi-driver-provider-1password/blob/main/docs/authentication.md", "pod", podInfo)
-			return nil, fmt.Errorf("attempting to set both nodePublishSecretRef and provider-adc auth")
+	if os.Getenv("DEBUG") == "true" {
+		klog.V(5).InfoS(fmt.Sprintf("attributes: %v", attrib), "pod", podRef)
+		klog.V(5).InfoS(fmt.Sprintf("secrets: %v", secret), "pod", podRef)
+	} else {
+		klog.V(5).InfoS("attributes: REDACTED (envvar DEBUG=true to see values)", "pod", podRef)
+		klog.V(5).InfoS("secrets: REDACTED (envvar DEBUG=true to see values)", "pod", podRef)
+	}
+	klog.V(5).InfoS(fmt.Sprintf("filePermission: %v", in.Permissions), "pod", podRef)
+	klog.V(5).InfoS(fmt.Sprintf("targetPath: %v", in.TargetPath), "pod", podRef)
+
+	if _, ok := attrib["secrets"]; !ok {
+		return nil, errors.New("missing required 'secrets' attribute")
+	}
+	if err := yaml.Unmarshal([]byte(attrib["secrets"]), &out.Secrets); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal secrets attribute: %v", err)
+	}
+	for i, s := range out.Secrets {
+		if s == nil {
+			return nil, fmt.Errorf("secrets[%d]: empty entry", i)
 		}
-		out.AuthProviderADC = true
-	case "pod-adc":
-		if out.AuthNodePublishSecret {
-			klog.InfoS("attempting to set both nodePublishSecretRef and pod-adc auth. For details consult https://github.com/GoogleCloudPlatform/secrets-store-csi-driver-provider-1password/blob/main/docs/authentication.md", "pod", podInfo)
-			return nil, fmt.Errorf("attempting to set both nodePublishSecretRef and pod-adc auth")
+		if err := parseSecret(s); err != nil {
+			return nil, fmt.Errorf("secrets[%d]: %v", i, err)
 		}
-		out.AuthPodADC = true
+	}
+
+	return out, nil
+}
+
+// ParsePodInfo returns the details of the pod of a mount from its attributes,
+// so that mounts Parse rejects can still be attributed to their pod.
+func ParsePodInfo(attributes string) (*PodInfo, error) {
+	var attrib map[string]string
+	if err := json.Unmarshal([]byte(attributes), &attrib); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal attributes: %v", err)
+	}
+	return podInfo(attrib), nil
+}
+
+func podInfo(attrib map[string]string) *PodInfo {
+	return &PodInfo{
+		Namespace:      attrib[attributePodNamespace],
+		Name:           attrib[attributePodName],
+		UID:            types.UID(attrib[attributePodUID]),
+		ServiceAccount: attrib[attributeServiceAccountName],
+	}
+}
+
+// parseAuth selects the credentials of the mount from the "auth" attribute and
+// the nodePublishSecretRef secret. Without an "auth" attribute the
+// nodePublishSecretRef is used if it holds a token.
+func parseAuth(out *MountConfig, auth string, secret map[string]string) error {
+	token, hasToken := secret[secretKeyToken]
+	switch auth {
 	case "":
-		// default to pod auth unless nodePublishSecret is set
-		out.AuthPodADC = !out.AuthNodePublishSecret
+		out.Auth = AuthProvider
+		if hasToken {
+			out.Auth = AuthNodePublishSecretRef
+		}
+	case AuthProvider:
+		if hasToken {
+			return fmt.Errorf("auth is %q but the nodePublishSecretRef holds a Connect token", AuthProvider)
+		}
+		out.Auth = AuthProvider
+	case AuthNodePublishSecretRef:
+		out.Auth = AuthNodePublishSecretRef
+	case "provider-adc", "pod-adc":
+		return fmt.Errorf("auth %q is not supported, use %q or %q", auth, AuthProvider, AuthNodePublishSecretRef)
 	default:
-		klog.InfoS("unknown auth configuration", "pod", podInfo)
-		return nil, fmt.Errorf("unknown auth configuration: %q", attrib["auth"])
+		return fmt.Errorf("unknown auth configuration: %q", auth)
 	}
 
-	if out.AuthNodePublishSecret {
-		klog.V(3).InfoS("parsed auth", "auth", "nodePublishSecretRef", "pod", podInfo)
+	if out.Auth != AuthNodePublishSecretRef {
+		if _, ok := secret[secretKeyURL]; ok {
+			return fmt.Errorf("nodePublishSecretRef key %q requires key %q", secretKeyURL, secretKeyToken)
+		}
+		return nil
 	}
-	if out.AuthPodADC {
-		klog.V(3).InfoS("parsed auth", "auth", "pod-adc", "pod", podInfo)
+
+	out.ConnectToken = strings.TrimSpace(token)
+	if out.ConnectToken == "" {
+		return fmt.Errorf("nodePublishSecretRef must hold a Connect token in key %q", secretKeyToken)
 	}
-	if out.AuthProviderADC {
-		klog.V(3).InfoS("parsed auth", "auth", "provider-adc", "pod", podInfo)
+	if raw := strings.TrimSpace(secret[secretKeyURL]); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return fmt.Errorf("nodePublishSecretRef key %q: invalid Connect server URL: %v", secretKeyURL, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("nodePublishSecretRef key %q: Connect server URL %q must be an absolute http or https URL", secretKeyURL, raw)
+		}
+		out.ConnectURL = raw
 	}
+	return nil
+}
 
-	if os.Getenv("DEBUG") == "true" {
-		klog.V(5).InfoS(fmt.Sprintf("attributes: %v", attrib), "pod", podInfo)
-		klog.V(5).InfoS(fmt.Sprintf("secrets: %v", secret), "pod", podInfo)
-	} else {
-		klog.V(5).InfoS("attributes: REDACTED (envvar DEBUG=true to see values)", "pod", podInfo)
-		klog.V(5).InfoS("secrets: REDACTED (envvar DEBUG=true to see values)", "pod", podInfo)
+// parseSecret validates the options of a single secret and populates its
+// Reference.
+func parseSecret(s *Secret) error {
+	switch s.MatchBy {
+	case "", MatchByID, MatchByTitle:
+	default:
+		return fmt.Errorf("unknown matchBy %q, must be %q or %q", s.MatchBy, MatchByID, MatchByTitle)
+	}
+	if s.Template != "" || s.Refs != nil {
+		return parseTemplateSecret(s)
 	}
-	klog.V(5).InfoS(fmt.Sprintf("filePermission: %v", in.Permissions), "pod", podInfo)
-	klog.V(5).InfoS(fmt.Sprintf("targetPath: %v", in.TargetPath), "pod", podInfo)
 
-	if _, ok := attrib["secrets"]; !ok {
-		return nil, errors.New("missing required 'secrets' attribute")
+	ref, err := ParseReference(s.ResourceName)
+	if err != nil {
+		return err
 	}
-	if err := yaml.Unmarshal([]byte(attrib["secrets"]), &out.Secrets); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal secrets attribute: %v", err)
+	s.Reference = ref
+
+	if s.Section != "" {
+		ref.Section = s.Section
+	}
+	if s.Field != "" {
+		ref.Field = s.Field
+	}
+	if ref.Section != "" && ref.Field == "" {
+		return errors.New("section requires a field")
+	}
+	if s.File != "" && ref.Field != "" {
+		return errors.New("file and field are mutually exclusive")
+	}
+	if s.Expand && (ref.Field != "" || s.File != "") {
+		return errors.New("expand requires a reference to a whole item")
+	}
+	if !s.Expand && s.SectionDirs {
+		return errors.New("sectionDirs requires expand")
 	}
 
-	return out, nil
+	switch s.Format {
+	case "", FormatDotenv, FormatJSON, FormatYAML, FormatProperties:
+	default:
+		return fmt.Errorf("unknown format %q, must be one of %q, %q, %q or %q", s.Format, FormatDotenv, FormatJSON, FormatYAML, FormatProperties)
+	}
+	switch s.KeyCase {
+	case "", KeyCaseUpperSnake, KeyCaseLowerSnake:
+	default:
+		return fmt.Errorf("unknown keyCase %q, must be %q or %q", s.KeyCase, KeyCaseUpperSnake, KeyCaseLowerSnake)
+	}
+	if s.Format != "" && (ref.Field != "" || s.File != "" || s.Expand) {
+		return errors.New("format requires a reference to a whole item and cannot be combined with expand")
+	}
+	if s.Format == "" && (s.KeyCase != "" || s.SectionPrefix) {
+		return errors.New("keyCase and sectionPrefix require format")
+	}
+	if !s.Expand && s.Format == "" && (s.Include != nil || s.Exclude != nil) {
+		return errors.New("include and exclude require expand or format")
+	}
+	return nil
+}
+
+// parseTemplateSecret validates a secret rendered from Template and populates
+// its TemplateRefs.
+func parseTemplateSecret(s *Secret) error {
+	if s.Template == "" {
+		return errors.New("refs require a template")
+	}
+	if len(s.Refs) == 0 {
+		return errors.New("template requires refs")
+	}
+	if s.ResourceName != "" || s.Section != "" || s.Field != "" || s.File != "" || s.Expand || s.Format != "" {
+		return errors.New("template cannot be combined with resourceName, section, field, file, expand or format")
+	}
+	if s.SectionDirs || s.KeyCase != "" || s.SectionPrefix || s.Include != nil || s.Exclude != nil {
+		return errors.New("template cannot be combined with sectionDirs, keyCase, sectionPrefix, include or exclude")
+	}
+	if s.PathString() == "" {
+		return errors.New("template requires a path")
+	}
+
+	s.TemplateRefs = make(map[string]*Reference, len(s.Refs))
+	for name, r := range s.Refs {
+		if name == "" {
+			return errors.New("refs: empty name")
+		}
+		ref, err := ParseReference(r)
+		if err != nil {
+			return fmt.Errorf("refs[%s]: %v", name, err)
+		}
+		if ref.Field == "" {
+			return fmt.Errorf("refs[%s]: reference %q must select a field or file", name, r)
+		}
+		s.TemplateRefs[name] = ref
+	}
+	return nil
 }
@@ -31,7 +31,7 @@ func TestParse(t *testing.T) {
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
 					"csi.storage.k8s.io/pod.uid": "123",
@@ -45,7 +45,8 @@ func TestParse(t *testing.T) {
 			want: &MountConfig{
 				Secrets: []*Secret{
 					{
-						ResourceName: "projects/project/secrets/test/versions/latest",
+						ResourceName: "op://vault/item/password",
+						Reference:    &Reference{Vault: "vault", Item: "item", Field: "password"},
 						FileName:     "good1.txt",
 					},
 				},
@@ -57,7 +58,7 @@ func TestParse(t *testing.T) {
 				},
 				TargetPath:  "/tmp/foo",
 				Permissions: 777,
-				AuthPodADC:  true,
+				Auth:        AuthProvider,
 			},
 		},
 		{
@@ -65,7 +66,7 @@ func TestParse(t *testing.T) {
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n  mode: 0600\n",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n  mode: 0600\n",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
 					"csi.storage.k8s.io/pod.uid": "123",
@@ -79,7 +80,8 @@ func TestParse(t *testing.T) {
 			want: &MountConfig{
 				Secrets: []*Secret{
 					{
-						ResourceName: "projects/project/secrets/test/versions/latest",
+						ResourceName: "op://vault/item/password",
+						Reference:    &Reference{Vault: "vault", Item: "item", Field: "password"},
 						FileName:     "good1.txt",
 						Mode:         int32Ptr(384), // octal 0600
 					},
@@ -92,7 +94,7 @@ func TestParse(t *testing.T) {
 				},
 				TargetPath:  "/tmp/foo",
 				Permissions: 777,
-				AuthPodADC:  true,
+				Auth:        AuthProvider,
 			},
 		},
 		{
@@ -100,7 +102,7 @@ func TestParse(t *testing.T) {
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n- resourceName: \"projects/project/secrets/test2/versions/latest\"\n  fileName: \"good2.txt\"\n",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n- resourceName: \"vaults/vault/secrets/item2\"\n  fileName: \"good2.txt\"\n",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
 					"csi.storage.k8s.io/pod.uid": "123",
@@ -114,11 +116,13 @@ func TestParse(t *testing.T) {
 			want: &MountConfig{
 				Secrets: []*Secret{
 					{
-						ResourceName: "projects/project/secrets/test/versions/latest",
+						ResourceName: "op://vault/item/password",
+						Reference:    &Reference{Vault: "vault", Item: "item", Field: "password"},
 						FileName:     "good1.txt",
 					},
 					{
-						ResourceName: "projects/project/secrets/test2/versions/latest",
+						ResourceName: "vaults/vault/secrets/item2",
+						Reference:    &Reference{Vault: "vault", Item: "item2"},
 						FileName:     "good2.txt",
 					},
 				},
@@ -130,7 +134,7 @@ func TestParse(t *testing.T) {
 				},
 				TargetPath:  "/tmp/foo",
 				Permissions: 777,
-				AuthPodADC:  true,
+				Auth:        AuthProvider,
 			},
 		},
 		{
@@ -138,7 +142,7 @@ func TestParse(t *testing.T) {
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n  mode: 256\n- resourceName: \"projects/project/secrets/test2/versions/latest\"\n  fileName: \"good2.txt\"\n  mode: 0600\n",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n  mode: 256\n- resourceName: \"vaults/vault/secrets/item2\"\n  fileName: \"good2.txt\"\n  mode: 0600\n",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
 					"csi.storage.k8s.io/pod.uid": "123",
@@ -152,12 +156,14 @@ func TestParse(t *testing.T) {
 			want: &MountConfig{
 				Secrets: []*Secret{
 					{
-						ResourceName: "projects/project/secrets/test/versions/latest",
+						ResourceName: "op://vault/item/password",
+						Reference:    &Reference{Vault: "vault", Item: "item", Field: "password"},
 						FileName:     "good1.txt",
 						Mode:         int32Ptr(256), // octal 0400
 					},
 					{
-						ResourceName: "projects/project/secrets/test2/versions/latest",
+						ResourceName: "vaults/vault/secrets/item2",
+						Reference:    &Reference{Vault: "vault", Item: "item2"},
 						FileName:     "good2.txt",
 						Mode:         int32Ptr(384), // octal 0600
 					},
@@ -170,7 +176,7 @@ func TestParse(t *testing.T) {
 				},
 				TargetPath:  "/tmp/foo",
 				Permissions: 777,
-				AuthPodADC:  true,
+				Auth:        AuthProvider,
 			},
 		},
 		{
@@ -178,21 +184,22 @@ func TestParse(t *testing.T) {
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
 					"csi.storage.k8s.io/pod.uid": "123",
 					"csi.storage.k8s.io/serviceAccount.name": "mysa"
 				}
 				`,
-				KubeSecrets: `{"key.json":"{\"private_key_id\": \"123\",\"private_key\": \"a-secret\",\"token_uri\": \"https://example.com/token\",\"type\": \"service_account\"}"}`,
+				KubeSecrets: `{"token":"a-token\n","url":"https://connect.example.com"}`,
 				TargetPath:  "/tmp/foo",
 				Permissions: 777,
 			},
 			want: &MountConfig{
 				Secrets: []*Secret{
 					{
-						ResourceName: "projects/project/secrets/test/versions/latest",
+						ResourceName: "op://vault/item/password",
+						Reference:    &Reference{Vault: "vault", Item: "item", Field: "password"},
 						FileName:     "good1.txt",
 					},
 				},
@@ -202,19 +209,20 @@ func TestParse(t *testing.T) {
 					UID:            "123",
 					ServiceAccount: "mysa",
 				},
-				TargetPath:            "/tmp/foo",
-				Permissions:           777,
-				AuthNodePublishSecret: true,
-				AuthKubeSecret:        []byte(`{"private_key_id": "123","private_key": "a-secret","token_uri": "https://example.com/token","type": "service_account"}`),
+				TargetPath:   "/tmp/foo",
+				Permissions:  777,
+				Auth:         AuthNodePublishSecretRef,
+				ConnectToken: "a-token",
+				ConnectURL:   "https://connect.example.com",
 			},
 		},
 		{
-			name: "Provider ADC auth",
+			name: "provider auth",
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n",
-					"auth": "provider-adc",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
+					"auth": "provider",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
 					"csi.storage.k8s.io/pod.uid": "123",
@@ -228,7 +236,8 @@ func TestParse(t *testing.T) {
 			want: &MountConfig{
 				Secrets: []*Secret{
 					{
-						ResourceName: "projects/project/secrets/test/versions/latest",
+						ResourceName: "op://vault/item/password",
+						Reference:    &Reference{Vault: "vault", Item: "item", Field: "password"},
 						FileName:     "good1.txt",
 					},
 				},
@@ -238,18 +247,54 @@ func TestParse(t *testing.T) {
 					UID:            "123",
 					ServiceAccount: "mysa",
 				},
-				TargetPath:      "/tmp/foo",
-				Permissions:     777,
-				AuthProviderADC: true,
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+				Auth:        AuthProvider,
 			},
 		},
 		{
-			name: "Pod ADC auth",
+			name: "explicit nodePublishSecretRef auth",
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n",
-					"auth": "pod-adc",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
+					"auth": "nodePublishSecretRef",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: `{"token":"a-token"}`,
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+			want: &MountConfig{
+				Secrets: []*Secret{
+					{
+						ResourceName: "op://vault/item/password",
+						Reference:    &Reference{Vault: "vault", Item: "item", Field: "password"},
+						FileName:     "good1.txt",
+					},
+				},
+				PodInfo: &PodInfo{
+					Namespace:      "default",
+					Name:           "mypod",
+					UID:            "123",
+					ServiceAccount: "mysa",
+				},
+				TargetPath:   "/tmp/foo",
+				Permissions:  777,
+				Auth:         AuthNodePublishSecretRef,
+				ConnectToken: "a-token",
+			},
+		},
+		{
+			name: "section and field selector",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item\"\n  fileName: \"good1.txt\"\n  section: replica\n  field: password\n",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
 					"csi.storage.k8s.io/pod.uid": "123",
@@ -263,8 +308,47 @@ func TestParse(t *testing.T) {
 			want: &MountConfig{
 				Secrets: []*Secret{
 					{
-						ResourceName: "projects/project/secrets/test/versions/latest",
+						ResourceName: "op://vault/item",
 						FileName:     "good1.txt",
+						Section:      "replica",
+						Field:        "password",
+						Reference:    &Reference{Vault: "vault", Item: "item", Section: "replica", Field: "password"},
+					},
+				},
+				PodInfo: &PodInfo{
+					Namespace:      "default",
+					Name:           "mypod",
+					UID:            "123",
+					ServiceAccount: "mysa",
+				},
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+				Auth:        AuthProvider,
+			},
+		},
+		{
+			name: "template",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- path: \"database.yml\"\n  template: \"password: {{ .password }}\"\n  refs:\n    password: \"op://vault/item/password\"\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+			want: &MountConfig{
+				Secrets: []*Secret{
+					{
+						Path:         "database.yml",
+						Template:     "password: {{ .password }}",
+						Refs:         map[string]string{"password": "op://vault/item/password"},
+						TemplateRefs: map[string]*Reference{"password": {Vault: "vault", Item: "item", Field: "password"}},
 					},
 				},
 				PodInfo: &PodInfo{
@@ -275,7 +359,7 @@ func TestParse(t *testing.T) {
 				},
 				TargetPath:  "/tmp/foo",
 				Permissions: 777,
-				AuthPodADC:  true,
+				Auth:        AuthProvider,
 			},
 		},
 	}
@@ -321,7 +405,7 @@ func TestParseErrors(t *testing.T) {
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n  mode: \"-rw-------\"",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n  mode: \"-rw-------\"",
 				}
 				`,
 				KubeSecrets: "",
@@ -334,7 +418,7 @@ func TestParseErrors(t *testing.T) {
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
 					"csi.storage.k8s.io/pod.uid": "123"
@@ -346,12 +430,30 @@ func TestParseErrors(t *testing.T) {
 			},
 		},
 		{
-			name: "both nodePublishSecretRef and provider-adc",
+			name: "provider auth with nodePublishSecretRef token",
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n",
-					"auth": "provider-adc",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
+					"auth": "provider",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: `{"token":"a-token"}`,
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "nodePublishSecretRef without token",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
+					"auth": "nodePublishSecretRef",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
 					"csi.storage.k8s.io/pod.uid": "123",
@@ -364,11 +466,215 @@ func TestParseErrors(t *testing.T) {
 			},
 		},
 		{
-			name: "both nodePublishSecretRef and pod-adc",
+			name: "invalid secret reference",
 			in: &MountParams{
 				Attributes: `
 				{
 					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "unknown matchBy",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n  matchBy: name\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "section without field",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item\"\n  fileName: \"good1.txt\"\n  section: replica\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "file and field",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n  file: cert.pem\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "expand with field",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  path: \"db\"\n  expand: true\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "include without expand",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item\"\n  path: \"db\"\n  include:\n    types: [CONCEALED]\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "unknown format",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item\"\n  path: \"app.env\"\n  format: toml\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "format with field",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  path: \"app.env\"\n  format: dotenv\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "keyCase without format",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item\"\n  path: \"db\"\n  expand: true\n  keyCase: upper-snake\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "template without refs",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- path: \"app.conf\"\n  template: \"static\"\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "template with resourceName",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  path: \"app.conf\"\n  template: \"{{ .a }}\"\n  refs:\n    a: \"op://vault/item/a\"\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "template ref without field",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- path: \"app.conf\"\n  template: \"{{ .a }}\"\n  refs:\n    a: \"op://vault/item\"\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "legacy pod-adc auth",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
 					"auth": "pod-adc",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
@@ -376,7 +682,59 @@ func TestParseErrors(t *testing.T) {
 					"csi.storage.k8s.io/serviceAccount.name": "mysa"
 				}
 				`,
-				KubeSecrets: `{"key.json":"{\"private_key_id\": \"123\",\"private_key\": \"a-secret\",\"token_uri\": \"https://example.com/token\",\"type\": \"service_account\"}"}`,
+				KubeSecrets: `{}`,
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "invalid Connect URL",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: `{"token":"a-token","url":"ftp://connect.example.com"}`,
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "Connect URL without token",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: `{"url":"https://connect.example.com"}`,
+				TargetPath:  "/tmp/foo",
+				Permissions: 777,
+			},
+		},
+		{
+			name: "invalid connect profile",
+			in: &MountParams{
+				Attributes: `
+				{
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
+					"connect": "Finance BU",
+					"csi.storage.k8s.io/pod.namespace": "default",
+					"csi.storage.k8s.io/pod.name": "mypod",
+					"csi.storage.k8s.io/pod.uid": "123",
+					"csi.storage.k8s.io/serviceAccount.name": "mysa"
+				}
+				`,
+				KubeSecrets: "{}",
 				TargetPath:  "/tmp/foo",
 				Permissions: 777,
 			},
@@ -386,7 +744,7 @@ func TestParseErrors(t *testing.T) {
 			in: &MountParams{
 				Attributes: `
 				{
-					"secrets": "- resourceName: \"projects/project/secrets/test/versions/latest\"\n  fileName: \"good1.txt\"\n",
+					"secrets": "- resourceName: \"op://vault/item/password\"\n  fileName: \"good1.txt\"\n",
 					"auth": "super-good-auth",
 					"csi.storage.k8s.io/pod.namespace": "default",
 					"csi.storage.k8s.io/pod.name": "mypod",
@@ -410,6 +768,20 @@ func TestParseErrors(t *testing.T) {
 	}
 }
 
+func TestParsePodInfo(t *testing.T) {
+	// The secrets are invalid, yet the pod can be named.
+	got, err := ParsePodInfo(`{"secrets": "- {}", "csi.storage.k8s.io/pod.namespace": "default", "csi.storage.k8s.io/pod.name": "mypod", "csi.storage.k8s.io/serviceAccount.name": "mysa"}`)
+	if err != nil {
+		t.Fatalf("ParsePodInfo() failed: %v", err)
+	}
+	if diff := cmp.Diff(&PodInfo{Namespace: "default", Name: "mypod", ServiceAccount: "mysa"}, got); diff != "" {
+		t.Errorf("ParsePodInfo() returned unexpected result (-want +got):\n%s", diff)
+	}
+	if _, err := ParsePodInfo("not json"); err == nil {
+		t.Errorf("ParsePodInfo() succeeded for malformed attributes, want error")
+	}
+}
+
 func int32Ptr(i int32) *int32 {
 	return &i
 }
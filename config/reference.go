@@ -0,0 +1,153 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	referenceScheme = "op://"
+	legacyVaults    = "vaults"
+	legacySecrets   = "secrets"
+)
+
+// Attributes that can be requested with the ?attribute= query parameter of a
+// secret reference.
+const (
+	AttributeValue   = "value"
+	AttributeType    = "type"
+	AttributeID      = "id"
+	AttributeLabel   = "label"
+	AttributePurpose = "purpose"
+	AttributeOTP     = "otp"
+)
+
+// Reference is a parsed pointer to a 1Password item or field.
+//
+// Two syntaxes are understood:
+//
+//	op://<vault>/<item>[/<section>]/<field>[?attribute=<attribute>]
+//	vaults/<vault>/secrets/<item>[/<field>]
+//
+// The first is the official 1Password secret reference syntax, the second is
+// the format originally inherited from the GCP provider. Vaults and items may
+// be referenced by name or ID in both.
+type Reference struct {
+	Vault   string
+	Item    string
+	Section string
+	Field   string
+	// Attribute selects which property of the field is returned. Empty means
+	// the field value.
+	Attribute string
+}
+
+// String returns the reference in op:// syntax.
+func (r *Reference) String() string {
+	parts := []string{r.Vault, r.Item}
+	if r.Section != "" {
+		parts = append(parts, r.Section)
+	}
+	if r.Field != "" {
+		parts = append(parts, r.Field)
+	}
+	s := referenceScheme + strings.Join(parts, "/")
+	if r.Attribute != "" {
+		s += "?attribute=" + r.Attribute
+	}
+	return s
+}
+
+// ParseReference parses a secret reference in either the op:// or the legacy
+// vaults/*/secrets/* syntax.
+func ParseReference(s string) (*Reference, error) {
+	if strings.HasPrefix(s, referenceScheme) {
+		return parseOPReference(s)
+	}
+	return parseLegacyReference(s)
+}
+
+func parseOPReference(s string) (*Reference, error) {
+	rest := strings.TrimPrefix(s, referenceScheme)
+	rest, rawQuery, _ := strings.Cut(rest, "?")
+
+	segments := strings.Split(rest, "/")
+	for _, seg := range segments {
+		if seg == "" {
+			return nil, fmt.Errorf("invalid secret reference %q: empty path segment", s)
+		}
+	}
+
+	ref := &Reference{}
+	switch len(segments) {
+	case 2:
+		ref.Vault, ref.Item = segments[0], segments[1]
+	case 3:
+		ref.Vault, ref.Item, ref.Field = segments[0], segments[1], segments[2]
+	case 4:
+		ref.Vault, ref.Item, ref.Section, ref.Field = segments[0], segments[1], segments[2], segments[3]
+	default:
+		return nil, fmt.Errorf("invalid secret reference %q: must be in format op://vault/item[/section]/field", s)
+	}
+
+	if rawQuery == "" {
+		return ref, nil
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret reference %q: %v", s, err)
+	}
+	for key, values := range query {
+		if key != "attribute" {
+			return nil, fmt.Errorf("invalid secret reference %q: unsupported query parameter %q", s, key)
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("invalid secret reference %q: attribute must be set exactly once", s)
+		}
+	}
+	ref.Attribute = strings.ToLower(query.Get("attribute"))
+	switch ref.Attribute {
+	case AttributeValue, AttributeType, AttributeID, AttributeLabel, AttributePurpose, AttributeOTP:
+	default:
+		return nil, fmt.Errorf("invalid secret reference %q: unknown attribute %q", s, ref.Attribute)
+	}
+	if ref.Field == "" {
+		return nil, fmt.Errorf("invalid secret reference %q: attribute requires a field", s)
+	}
+	return ref, nil
+}
+
+func parseLegacyReference(s string) (*Reference, error) {
+	split := strings.Split(s, "/")
+	if (len(split) != 4 && len(split) != 5) || split[0] != legacyVaults || split[2] != legacySecrets {
+		return nil, fmt.Errorf("invalid secret reference %q: must be in format op://vault/item[/section]/field or vaults/vault/secrets/item[/field]", s)
+	}
+	for _, seg := range split {
+		if seg == "" {
+			return nil, fmt.Errorf("invalid secret reference %q: empty path segment", s)
+		}
+	}
+	ref := &Reference{
+		Vault: split[1],
+		Item:  split[3],
+	}
+	if len(split) == 5 {
+		ref.Field = split[4]
+	}
+	return ref, nil
+}
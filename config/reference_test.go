@@ -0,0 +1,126 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want *Reference
+	}{
+		{
+			name: "item only",
+			in:   "op://Production/Postgres",
+			want: &Reference{Vault: "Production", Item: "Postgres"},
+		},
+		{
+			name: "field",
+			in:   "op://Production/Postgres/password",
+			want: &Reference{Vault: "Production", Item: "Postgres", Field: "password"},
+		},
+		{
+			name: "section and field",
+			in:   "op://Production/Postgres/replica/password",
+			want: &Reference{Vault: "Production", Item: "Postgres", Section: "replica", Field: "password"},
+		},
+		{
+			name: "names with spaces",
+			in:   "op://Shared Vault/My Login/one-time password",
+			want: &Reference{Vault: "Shared Vault", Item: "My Login", Field: "one-time password"},
+		},
+		{
+			name: "attribute",
+			in:   "op://Production/GitHub/one-time password?attribute=otp",
+			want: &Reference{Vault: "Production", Item: "GitHub", Field: "one-time password", Attribute: AttributeOTP},
+		},
+		{
+			name: "attribute is case insensitive",
+			in:   "op://Production/GitHub/password?attribute=TYPE",
+			want: &Reference{Vault: "Production", Item: "GitHub", Field: "password", Attribute: AttributeType},
+		},
+		{
+			name: "legacy item",
+			in:   "vaults/i7qrtqvqyko35dcv6dgr4savaa/secrets/oi5yyo2xzgn6mh65gl3keu7a7u",
+			want: &Reference{Vault: "i7qrtqvqyko35dcv6dgr4savaa", Item: "oi5yyo2xzgn6mh65gl3keu7a7u"},
+		},
+		{
+			name: "legacy field",
+			in:   "vaults/i7qrtqvqyko35dcv6dgr4savaa/secrets/oi5yyo2xzgn6mh65gl3keu7a7u/password",
+			want: &Reference{Vault: "i7qrtqvqyko35dcv6dgr4savaa", Item: "oi5yyo2xzgn6mh65gl3keu7a7u", Field: "password"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseReference(tc.in)
+			if err != nil {
+				t.Fatalf("ParseReference() failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ParseReference() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseReferenceErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{name: "empty", in: ""},
+		{name: "vault only", in: "op://Production"},
+		{name: "too many segments", in: "op://Production/Postgres/replica/password/extra"},
+		{name: "empty segment", in: "op://Production//password"},
+		{name: "trailing slash", in: "op://Production/Postgres/"},
+		{name: "unknown attribute", in: "op://Production/Postgres/password?attribute=color"},
+		{name: "unknown query parameter", in: "op://Production/Postgres/password?format=json"},
+		{name: "repeated attribute", in: "op://Production/Postgres/password?attribute=otp&attribute=type"},
+		{name: "attribute without field", in: "op://Production/Postgres?attribute=otp"},
+		{name: "gcp resource name", in: "projects/project/secrets/test/versions/latest"},
+		{name: "legacy too short", in: "vaults/abc/secrets"},
+		{name: "legacy wrong keywords", in: "vault/abc/secret/def"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ParseReference(tc.in); err == nil {
+				t.Errorf("ParseReference(%q) succeeded for malformed input, want error", tc.in)
+			}
+		})
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	tests := []struct {
+		in   *Reference
+		want string
+	}{
+		{in: &Reference{Vault: "v", Item: "i"}, want: "op://v/i"},
+		{in: &Reference{Vault: "v", Item: "i", Field: "f"}, want: "op://v/i/f"},
+		{in: &Reference{Vault: "v", Item: "i", Section: "s", Field: "f", Attribute: AttributeOTP}, want: "op://v/i/s/f?attribute=otp"},
+	}
+	for _, tc := range tests {
+		if got := tc.in.String(); got != tc.want {
+			t.Errorf("Reference.String() = %q, want %q", got, tc.want)
+		}
+	}
+}
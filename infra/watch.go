@@ -0,0 +1,57 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package infra
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// WatchFile polls the file at path every interval and calls onChange with the
+// new content whenever it differs from initial. Polling the content instead of
+// watching inotify events also picks up ConfigMap and Secret volume updates,
+// which replace a symlink in the parent directory. Read errors, e.g. of a
+// removed file, are logged and passed to onError unless it is nil; the next
+// successful read is compared with the last content read. WatchFile returns
+// when ctx is done.
+func WatchFile(ctx context.Context, path string, interval time.Duration, initial []byte, onChange func([]byte), onError func(error)) {
+	last := initial
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			klog.ErrorS(err, "unable to read watched file", "path", path)
+			if onError != nil {
+				onError(err)
+			}
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+		onChange(data)
+	}
+}
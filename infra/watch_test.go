@@ -0,0 +1,75 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package infra
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watched")
+	if err := os.WriteFile(path, []byte("one"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 10)
+	errs := make(chan error, 1)
+	go WatchFile(ctx, path, time.Millisecond, []byte("one"), func(data []byte) {
+		changes <- string(data)
+	}, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	if err := os.WriteFile(path, []byte("two"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-changes:
+		if got != "two" {
+			t.Errorf("WatchFile() reported %q, want %q", got, "two")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchFile() did not report the change")
+	}
+
+	// Unchanged content is not reported again.
+	select {
+	case got := <-changes:
+		t.Errorf("WatchFile() reported unchanged content %q", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// A removed file is reported as an error.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if !os.IsNotExist(err) {
+			t.Errorf("WatchFile() reported error %v, want a missing file", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchFile() did not report the removed file")
+	}
+}
@@ -18,7 +18,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
@@ -30,12 +32,24 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/1Password/connect-sdk-go/connect"
 	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/infra"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/policy"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/profiles"
 	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/server"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	logsapi "k8s.io/component-base/logs/api/v1"
 	jlogs "k8s.io/component-base/logs/json"
 	"k8s.io/klog/v2"
@@ -43,11 +57,36 @@ import (
 )
 
 var (
-	logFormatJSON = flag.Bool("log-format-json", true, "set log formatter to json")
-	metricsAddr   = flag.String("metrics_addr", ":8095", "configure http listener for reporting metrics")
-	enableProfile = flag.Bool("enable-pprof", false, "enable pprof profiling")
-	debugAddr     = flag.String("debug_addr", "localhost:6060", "port for pprof profiling")
-	_             = flag.Bool("write_secrets", false, "[unused]")
+	logFormatJSON    = flag.Bool("log-format-json", true, "set log formatter to json")
+	metricsAddr      = flag.String("metrics_addr", ":8095", "configure http listener for reporting metrics")
+	enableProfile    = flag.Bool("enable-pprof", false, "enable pprof profiling")
+	debugAddr        = flag.String("debug_addr", "localhost:6060", "port for pprof profiling")
+	maxFileSize      = flag.Int64("max-file-size", 1<<20, "largest file attachment or rendered template in bytes that can be mounted, 0 for no limit")
+	tokenFile        = flag.String("connect-token-file", "", "path to a file holding the Connect token, reloaded on change, used instead of CONNECT_TOKEN without -connect-config")
+	tokenReload      = flag.Duration("token-reload-interval", 10*time.Second, "how often token files of profiles are checked for changes")
+	connectConfig    = flag.String("connect-config", "", "path to a provider config file defining named Connect and service account profiles, defaults to a single profile from CONNECT_SERVER and CONNECT_TOKEN")
+	cacheTTL         = flag.Duration("cache-ttl", 0, "how long vault and item lookups are cached and shared between mounts, 0 disables the cache")
+	cacheSize        = flag.Int("cache-max-items", 1000, "largest number of cached vault and item lookups")
+	staleIfError     = flag.Duration("stale-if-error", 0, "how long vault and item lookups are served from earlier mounts while the backend is unavailable, 0 fails mounts instead")
+	retryAttempts    = flag.Int("retry-attempts", 3, "how often a backend call failing with a timeout, 429 or 5xx error is attempted, 1 disables retries")
+	retryDelay       = flag.Duration("retry-base-delay", 200*time.Millisecond, "delay before the first retry of a backend call, doubled for every further retry")
+	circuitFails     = flag.Int("circuit-failure-threshold", 5, "consecutive failures of a Connect server after which mounts fail fast, 0 disables the circuit breaker")
+	circuitOpen      = flag.Duration("circuit-open-timeout", 30*time.Second, "how long mounts fail fast before a Connect server is tried again")
+	concurrency      = flag.Int("backend-concurrency", 16, "largest number of concurrent backend calls of all mounts on the node, 0 for no limit")
+	rateLimit        = flag.Float64("backend-rate-limit", 20, "backend calls per second to each Connect server, 0 for no limit")
+	rateBurst        = flag.Int("backend-rate-burst", 40, "backend calls to each Connect server allowed at once above -backend-rate-limit")
+	otlpEndpoint     = flag.String("otlp-endpoint", "", "host:port of an OTLP gRPC collector traces are exported to, tracing is disabled if empty")
+	otlpInsecure     = flag.Bool("otlp-insecure", false, "export traces to -otlp-endpoint without TLS")
+	traceSampling    = flag.Float64("trace-sample-ratio", 0.1, "fraction of mount requests traced, between 0 and 1")
+	healthInterval   = flag.Duration("health-check-interval", 30*time.Second, "how often the Connect servers of all profiles are checked")
+	healthTimeout    = flag.Duration("health-check-timeout", 10*time.Second, "how long a health check of a profile may take")
+	healthSAInterval = flag.Duration("health-check-service-account-interval", 15*time.Minute, "how often the service accounts of profiles are checked, as every check counts against the rate limits of 1Password")
+	grpcReflection   = flag.Bool("grpc-reflection", false, "serve gRPC reflection on the provider socket")
+	auditLog         = flag.String("audit-log", "", "path of a file every mount is recorded in as a line of JSON, - for stdout, auditing is disabled if empty")
+	policyFile       = flag.String("policy-file", "", "path to an access policy restricting the vaults and items pods may mount, all mounts are allowed if empty")
+	versionKey       = flag.String("version-key-file", "", "path to a file holding the key object versions of secrets are derived from, a random key is used if empty, changing versions on every restart")
+	policyReload     = flag.Duration("policy-reload-interval", 10*time.Second, "how often the access policy file is checked for changes")
+	_                = flag.Bool("write_secrets", false, "[unused]")
 
 	version = "dev"
 )
@@ -70,22 +109,60 @@ func main() {
 	ua := fmt.Sprintf("secrets-store-csi-driver-provider-1password/%s", version)
 	klog.InfoS(fmt.Sprintf("starting %s", ua))
 
-	// setup onepassword connect client
-	op := connect.NewClient(os.Getenv("CONNECT_SERVER"), os.Getenv("CONNECT_TOKEN"))
-	klog.InfoS("Connected to OnePassword Connect")
-
-	vaults, err := op.GetVaults()
+	// initialize metrics before any component records them
+	exporter, err := otelprom.New()
 	if err != nil {
-		klog.ErrorS(err, "unable to list 1p vaults we should have access to")
-		klog.Fatalln("unable to start")
+		klog.ErrorS(err, "unable to initialize prometheus registry")
+		klog.Fatalln("unable to initialize prometheus registry")
 	}
-	for _, v := range vaults {
-		klog.InfoS("Found vault %s", v.Name)
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter)))
+	if *otlpEndpoint != "" {
+		tp := initTracing(ctx, *otlpEndpoint, *otlpInsecure, *traceSampling)
+		defer func() {
+			// ctx is done by now; give the exporter a moment to flush.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tp.Shutdown(ctx); err != nil {
+				klog.ErrorS(err, "unable to flush traces")
+			}
+		}()
 	}
 
 	// setup provider grpc server
 	s := &server.Server{
-		OnePasswordClient: op,
+		Clients:     loadProfiles(*connectConfig, *tokenFile, ua),
+		MaxFileSize: *maxFileSize,
+	}
+	if *versionKey != "" {
+		s.VersionKey = readVersionKey(*versionKey)
+	}
+	s.Clients.WatchTokens(ctx, *tokenReload)
+	s.Limiter = server.NewLimiter(*concurrency, *rateLimit, *rateBurst)
+	s.Resilience = server.NewResilience(*retryAttempts, *retryDelay, *circuitFails, *circuitOpen)
+	if *cacheTTL > 0 {
+		s.Cache = server.NewCache(*cacheTTL, *cacheSize)
+	}
+	if *staleIfError > 0 {
+		stale, err := server.NewStaleStore(*staleIfError)
+		if err != nil {
+			klog.ErrorS(err, "unable to create stale store")
+			klog.Fatalln("unable to start")
+		}
+		s.Stale = stale
+	}
+
+	// check access of the onepassword connect clients and service accounts
+	// in the background: while they are unreachable mounts are served from
+	// cached data where available.
+	health := server.NewHealth(s, *healthTimeout, *healthSAInterval)
+	go health.Run(ctx, *healthInterval)
+
+	if *auditLog != "" {
+		s.Audit = openAuditLog(*auditLog)
+	}
+
+	if *policyFile != "" {
+		s.Authorizer = loadPolicy(ctx, *policyFile, *policyReload, s.Clients.Default())
 	}
 
 	socketPath := filepath.Join(os.Getenv("TARGET_DIR"), "1password.sock")
@@ -104,6 +181,12 @@ func main() {
 		grpc.UnaryInterceptor(infra.LogInterceptor()),
 	)
 	v1alpha1.RegisterCSIDriverProviderServer(g, s)
+	hs := grpchealth.NewServer()
+	health.ReportTo(hs)
+	healthpb.RegisterHealthServer(g, hs)
+	if *grpcReflection {
+		reflection.Register(g)
+	}
 	go g.Serve(l)
 
 	// initialize metrics and health http server
@@ -115,15 +198,51 @@ func main() {
 	}
 	defer ms.Shutdown(ctx)
 
-	_, err = otelprom.New()
-	if err != nil {
-		klog.ErrorS(err, "unable to initialize prometheus registry")
-		klog.Fatalln("unable to initialize prometheus registry")
-	}
-
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.HandleFunc("/live", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
+		// Live while the provider socket the driver connects to exists.
+		// Open circuit breakers are reported but do not fail the probe:
+		// restarting the provider does not bring Connect back.
+		socket := "ok"
+		if fi, err := os.Stat(socketPath); err != nil || fi.Mode()&os.ModeSocket == 0 {
+			socket = "missing"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if socket != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"socket":          socket,
+			"circuitBreakers": s.Resilience.States(),
+		})
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		// Ready while the backend of the default profile is healthy. Mounts
+		// are served either way, so this is for monitoring only and not
+		// the readiness probe, which would stall rollouts while Connect is
+		// down.
+		ready := health.Ready()
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ready":   ready,
+			"profile": s.Clients.Default(),
+		})
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := "ok"
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Healthy() {
+			status = "degraded"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":          status,
+			"backends":        health.Statuses(),
+			"circuitBreakers": s.Resilience.States(),
+		})
 	})
 	go func() {
 		if err := ms.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -155,5 +274,144 @@ func main() {
 
 	<-ctx.Done()
 	klog.InfoS("terminating")
+	hs.Shutdown()
 	g.GracefulStop()
 }
+
+// initTracing exports the spans of the given fraction of mount requests to
+// the OTLP collector at endpoint.
+func initTracing(ctx context.Context, endpoint string, insecure bool, ratio float64) *sdktrace.TracerProvider {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		klog.ErrorS(err, "unable to create OTLP trace exporter", "endpoint", endpoint)
+		klog.Fatalln("unable to start")
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "secrets-store-csi-driver-provider-1password"),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	klog.InfoS("exporting traces", "endpoint", endpoint, "sampleRatio", ratio)
+	return tp
+}
+
+// loadProfiles reads the profiles from the provider config file at
+// path, or builds a single default profile from the CONNECT_SERVER
+// environment variable and tokenFile or the CONNECT_TOKEN environment variable
+// if path is empty.
+func loadProfiles(path, tokenFile, userAgent string) *profiles.Registry {
+	var cfg *profiles.Config
+	if path == "" {
+		p := &profiles.Profile{URL: os.Getenv("CONNECT_SERVER"), TokenFile: tokenFile}
+		if tokenFile == "" {
+			p.TokenEnv = "CONNECT_TOKEN"
+		}
+		cfg = &profiles.Config{
+			Profiles: map[string]*profiles.Profile{"default": p},
+		}
+		if err := cfg.Validate(); err != nil {
+			klog.ErrorS(err, "invalid CONNECT_SERVER, CONNECT_TOKEN or -connect-token-file")
+			klog.Fatalln("unable to start")
+		}
+	} else {
+		if tokenFile != "" {
+			klog.ErrorS(nil, "-connect-token-file cannot be used with -connect-config, set tokenFile in the profiles instead")
+			klog.Fatalln("unable to start")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			klog.ErrorS(err, "unable to read provider config", "path", path)
+			klog.Fatalln("unable to start")
+		}
+		if cfg, err = profiles.Parse(data); err != nil {
+			klog.ErrorS(err, "unable to parse provider config", "path", path)
+			klog.Fatalln("unable to start")
+		}
+	}
+
+	clients, err := profiles.Load(cfg, userAgent)
+	if err != nil {
+		klog.ErrorS(err, "unable to set up 1Password clients")
+		klog.Fatalln("unable to start")
+	}
+	klog.InfoS("configured profiles", "profiles", clients.Names(), "default", clients.Default())
+	return clients
+}
+
+// readVersionKey returns the object version key in the file at path.
+func readVersionKey(path string) []byte {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		klog.ErrorS(err, "unable to read version key", "path", path)
+		klog.Fatalln("unable to start")
+	}
+	if len(bytes.TrimSpace(key)) < 16 {
+		klog.ErrorS(nil, "version key is too short, want at least 16 bytes", "path", path)
+		klog.Fatalln("unable to start")
+	}
+	return bytes.TrimSpace(key)
+}
+
+// openAuditLog returns an audit log appending to the file at path, or
+// writing to stdout if path is "-".
+func openAuditLog(path string) *server.AuditLog {
+	if path == "-" {
+		return server.NewAuditLog(os.Stdout)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		klog.ErrorS(err, "unable to open audit log", "path", path)
+		klog.Fatalln("unable to start")
+	}
+	klog.InfoS("writing audit log", "path", path)
+	return server.NewAuditLog(f)
+}
+
+// loadPolicy reads the access policy at path and keeps it up to date. Invalid
+// updates are logged and the previous policy stays in force. Mounts that do
+// not select a profile are checked as mounts of defaultProfile.
+func loadPolicy(ctx context.Context, path string, interval time.Duration, defaultProfile string) *policy.Authorizer {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		klog.ErrorS(err, "unable to read access policy", "path", path)
+		klog.Fatalln("unable to start")
+	}
+	p, err := policy.Parse(data)
+	if err != nil {
+		klog.ErrorS(err, "unable to parse access policy", "path", path)
+		klog.Fatalln("unable to start")
+	}
+
+	// Pod labels are only needed for rules with a podSelector; without API
+	// access those rules never match.
+	var labels policy.LabelSource
+	if rc, err := rest.InClusterConfig(); err != nil {
+		klog.ErrorS(err, "unable to configure kubernetes client, podSelector rules will not match")
+	} else if kc, err := kubernetes.NewForConfig(rc); err != nil {
+		klog.ErrorS(err, "unable to create kubernetes client, podSelector rules will not match")
+	} else {
+		labels = &policy.KubeLabelSource{Client: kc}
+	}
+
+	a := policy.NewAuthorizer(p, labels, defaultProfile)
+	klog.InfoS("loaded access policy", "path", path, "rules", len(p.Rules))
+
+	go infra.WatchFile(ctx, path, interval, data, func(data []byte) {
+		p, err := policy.Parse(data)
+		if err != nil {
+			klog.ErrorS(err, "unable to parse updated access policy, keeping the previous policy", "path", path)
+			return
+		}
+		a.Update(p)
+		klog.InfoS("reloaded access policy", "path", path, "rules", len(p.Rules))
+	}, nil)
+	return a
+}
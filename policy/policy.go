@@ -0,0 +1,239 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy restricts the vaults and items that pods may mount based on
+// their namespace, service account and labels, and the Connect profile they
+// mount them through.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync/atomic"
+
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Policy is the parsed content of a policy file. A mount is allowed if every
+// vault and item it references is allowed by at least one rule that applies
+// to the pod.
+type Policy struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// Rule allows pods matching Namespaces, ServiceAccounts and PodSelector to
+// mount the items matching Items in the vaults matching Vaults through the
+// profiles matching Profiles. Namespaces, service accounts, profiles, vaults
+// and items are matched with path.Match patterns, e.g. "*" or "team-*".
+// Vaults and items are matched against the values written in the secret
+// references, which may be titles or IDs.
+type Rule struct {
+	// Namespaces of the pods the rule applies to.
+	Namespaces []string `yaml:"namespaces"`
+	// ServiceAccounts optionally restricts the rule to pods running as one
+	// of these service accounts.
+	ServiceAccounts []string `yaml:"serviceAccounts,omitempty"`
+	// PodSelector optionally restricts the rule to pods whose labels match
+	// this label selector, e.g. "app=api,tier in (backend)".
+	PodSelector string `yaml:"podSelector,omitempty"`
+	// Profiles are the Connect profiles, selected by the "connect"
+	// attribute, the pods may mount the items through. Empty allows the
+	// default profile only, as vaults of the same title on different servers
+	// are different vaults.
+	Profiles []string `yaml:"profiles,omitempty"`
+	// Vaults the pods may mount items from.
+	Vaults []string `yaml:"vaults"`
+	// Items optionally restricts the items of Vaults the pods may mount.
+	Items []string `yaml:"items,omitempty"`
+
+	selector labels.Selector
+}
+
+// Parse parses and validates a policy file.
+func Parse(data []byte) (*Policy, error) {
+	p := &Policy{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	for i, r := range p.Rules {
+		if err := r.parse(); err != nil {
+			return nil, fmt.Errorf("invalid policy: rules[%d]: %v", i, err)
+		}
+	}
+	return p, nil
+}
+
+func (r *Rule) parse() error {
+	if r == nil {
+		return errors.New("empty rule")
+	}
+	if len(r.Namespaces) == 0 {
+		return errors.New("namespaces is required, use \"*\" for all namespaces")
+	}
+	if len(r.Vaults) == 0 {
+		return errors.New("vaults is required, use \"*\" for all vaults")
+	}
+	for _, patterns := range [][]string{r.Namespaces, r.ServiceAccounts, r.Profiles, r.Vaults, r.Items} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", p, err)
+			}
+		}
+	}
+	if r.PodSelector != "" {
+		s, err := labels.Parse(r.PodSelector)
+		if err != nil {
+			return fmt.Errorf("invalid podSelector: %v", err)
+		}
+		r.selector = s
+	}
+	return nil
+}
+
+// appliesTo reports whether the rule applies to pods in namespace running as
+// serviceAccount mounting through profile, ignoring PodSelector.
+// defaultProfile is the name of the default profile.
+func (r *Rule) appliesTo(namespace, serviceAccount, profile, defaultProfile string) bool {
+	if !matchAny(r.Namespaces, namespace) || (len(r.ServiceAccounts) > 0 && !matchAny(r.ServiceAccounts, serviceAccount)) {
+		return false
+	}
+	if len(r.Profiles) == 0 {
+		return profile == defaultProfile
+	}
+	return matchAny(r.Profiles, profile)
+}
+
+// allows reports whether the rule allows the item of ref.
+func (r *Rule) allows(ref *config.Reference) bool {
+	return matchAny(r.Vaults, ref.Vault) && (len(r.Items) == 0 || matchAny(r.Items, ref.Item))
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelSource looks up the labels of a pod.
+type LabelSource interface {
+	PodLabels(ctx context.Context, namespace, name string) (map[string]string, error)
+}
+
+// Authorizer enforces the current Policy. The policy can be replaced at any
+// time with Update.
+type Authorizer struct {
+	policy         atomic.Pointer[Policy]
+	labels         LabelSource
+	defaultProfile string
+}
+
+// NewAuthorizer returns an Authorizer enforcing p. Mounts that do not select
+// a profile use defaultProfile. Rules with a podSelector never match if
+// labels is nil.
+func NewAuthorizer(p *Policy, labels LabelSource, defaultProfile string) *Authorizer {
+	a := &Authorizer{labels: labels, defaultProfile: defaultProfile}
+	a.policy.Store(p)
+	return a
+}
+
+// Update replaces the enforced policy.
+func (a *Authorizer) Update(p *Policy) {
+	a.policy.Store(p)
+}
+
+// Authorize returns a PermissionDenied status error if the pod of cfg is not
+// allowed to mount every item referenced by its secrets.
+func (a *Authorizer) Authorize(ctx context.Context, cfg *config.MountConfig) error {
+	p := a.policy.Load()
+	pod := cfg.PodInfo
+	if pod == nil || pod.Namespace == "" {
+		return status.Error(codes.PermissionDenied, "access policy: mount request has no pod namespace")
+	}
+
+	profile := cfg.Profile
+	if profile == "" {
+		profile = a.defaultProfile
+	}
+	var rules []*Rule
+	for _, r := range p.Rules {
+		if r.appliesTo(pod.Namespace, pod.ServiceAccount, profile, a.defaultProfile) {
+			rules = append(rules, r)
+		}
+	}
+
+	// Pod labels are only looked up if a rule with a selector is needed.
+	var podLabels labels.Set
+	var labelsErr error
+	fetched := false
+	matches := func(r *Rule) bool {
+		if r.selector == nil {
+			return true
+		}
+		if !fetched {
+			fetched = true
+			if a.labels == nil {
+				labelsErr = errors.New("pod labels are not available")
+			} else {
+				var l map[string]string
+				l, labelsErr = a.labels.PodLabels(ctx, pod.Namespace, pod.Name)
+				podLabels = labels.Set(l)
+			}
+		}
+		return labelsErr == nil && r.selector.Matches(podLabels)
+	}
+
+	for _, ref := range references(cfg) {
+		allowed := false
+		for _, r := range rules {
+			if r.allows(ref) && matches(r) {
+				allowed = true
+				break
+			}
+		}
+		if allowed {
+			continue
+		}
+		if labelsErr != nil {
+			return status.Errorf(codes.PermissionDenied, "access policy: unable to look up the labels of pod %s/%s: %v", pod.Namespace, pod.Name, labelsErr)
+		}
+		return status.Errorf(codes.PermissionDenied, "access policy: pod %s/%s (service account %q) is not allowed to mount item %q of vault %q through profile %q", pod.Namespace, pod.Name, pod.ServiceAccount, ref.Item, ref.Vault, profile)
+	}
+	return nil
+}
+
+// references returns all secret references of cfg.
+func references(cfg *config.MountConfig) []*config.Reference {
+	var refs []*config.Reference
+	for _, s := range cfg.Secrets {
+		if s.Reference != nil {
+			refs = append(refs, s.Reference)
+		}
+		for _, ref := range s.TemplateRefs {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
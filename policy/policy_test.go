@@ -0,0 +1,237 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testPolicy = `
+rules:
+  - namespaces: [payments]
+    serviceAccounts: [api]
+    vaults: [Payments]
+    items: ["stripe-*", Postgres]
+  - namespaces: ["team-*"]
+    vaults: [Shared]
+  - namespaces: [web]
+    podSelector: "app=frontend"
+    vaults: [Web]
+  - namespaces: [ci]
+    profiles: [ci, "team-*"]
+    vaults: [CI]
+`
+
+type fakeLabels struct {
+	labels map[string]string
+	err    error
+	calls  int
+}
+
+func (f *fakeLabels) PodLabels(ctx context.Context, namespace, name string) (map[string]string, error) {
+	f.calls++
+	return f.labels, f.err
+}
+
+func mountConfig(namespace, serviceAccount string, refs ...string) *config.MountConfig {
+	cfg := &config.MountConfig{
+		PodInfo: &config.PodInfo{Namespace: namespace, Name: "pod", ServiceAccount: serviceAccount},
+	}
+	for _, r := range refs {
+		ref, err := config.ParseReference(r)
+		if err != nil {
+			panic(err)
+		}
+		cfg.Secrets = append(cfg.Secrets, &config.Secret{ResourceName: r, Reference: ref})
+	}
+	return cfg
+}
+
+// withProfile returns cfg mounting through profile.
+func withProfile(cfg *config.MountConfig, profile string) *config.MountConfig {
+	cfg.Profile = profile
+	return cfg
+}
+
+func TestAuthorize(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		cfg      *config.MountConfig
+		labels   *fakeLabels
+		wantCode codes.Code
+	}{
+		{
+			name: "allowed item",
+			cfg:  mountConfig("payments", "api", "op://Payments/stripe-live/key", "op://Payments/Postgres/password"),
+		},
+		{
+			name:     "other item",
+			cfg:      mountConfig("payments", "api", "op://Payments/stripe-live/key", "op://Payments/Admin/password"),
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:     "other service account",
+			cfg:      mountConfig("payments", "default", "op://Payments/stripe-live/key"),
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:     "other vault",
+			cfg:      mountConfig("payments", "api", "op://Shared/stripe-live/key"),
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name: "namespace pattern",
+			cfg:  mountConfig("team-a", "default", "op://Shared/anything/password"),
+		},
+		{
+			name:     "unlisted namespace",
+			cfg:      mountConfig("default", "default", "op://Shared/anything/password"),
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:   "pod selector",
+			cfg:    mountConfig("web", "default", "op://Web/site/password"),
+			labels: &fakeLabels{labels: map[string]string{"app": "frontend"}},
+		},
+		{
+			name:     "pod selector mismatch",
+			cfg:      mountConfig("web", "default", "op://Web/site/password"),
+			labels:   &fakeLabels{labels: map[string]string{"app": "backend"}},
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:     "pod labels unavailable",
+			cfg:      mountConfig("web", "default", "op://Web/site/password"),
+			labels:   &fakeLabels{err: errors.New("forbidden")},
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name: "default profile by name",
+			cfg:  withProfile(mountConfig("payments", "api", "op://Payments/stripe-live/key"), "default"),
+		},
+		{
+			name:     "other profile",
+			cfg:      withProfile(mountConfig("payments", "api", "op://Payments/stripe-live/key"), "team-b"),
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name: "listed profile",
+			cfg:  withProfile(mountConfig("ci", "default", "op://CI/deploy-key/private key"), "team-b"),
+		},
+		{
+			name:     "default profile not listed",
+			cfg:      mountConfig("ci", "default", "op://CI/deploy-key/private key"),
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:     "no namespace",
+			cfg:      mountConfig("", "default", "op://Shared/anything/password"),
+			wantCode: codes.PermissionDenied,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var source LabelSource
+			if tc.labels != nil {
+				source = tc.labels
+			}
+			err := NewAuthorizer(p, source, "default").Authorize(context.Background(), tc.cfg)
+			if code := status.Code(err); code != tc.wantCode {
+				t.Errorf("Authorize() got code %v, want %v (err = %v)", code, tc.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestAuthorizeTemplateRefs(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	cfg := mountConfig("payments", "api")
+	cfg.Secrets = append(cfg.Secrets, &config.Secret{
+		Path: "config",
+		TemplateRefs: map[string]*config.Reference{
+			"a": {Vault: "Payments", Item: "Postgres", Field: "password"},
+			"b": {Vault: "Payments", Item: "Admin", Field: "password"},
+		},
+	})
+	if code := status.Code(NewAuthorizer(p, nil, "default").Authorize(context.Background(), cfg)); code != codes.PermissionDenied {
+		t.Errorf("Authorize() got code %v, want %v", code, codes.PermissionDenied)
+	}
+}
+
+func TestAuthorizerUpdate(t *testing.T) {
+	deny, err := Parse([]byte("rules: []"))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	allow, err := Parse([]byte(`rules: [{namespaces: ["*"], vaults: ["*"]}]`))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	cfg := mountConfig("default", "default", "op://Any/item/field")
+
+	a := NewAuthorizer(deny, nil, "default")
+	if err := a.Authorize(context.Background(), cfg); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Authorize() with empty policy got err = %v, want PermissionDenied", err)
+	}
+	a.Update(allow)
+	if err := a.Authorize(context.Background(), cfg); err != nil {
+		t.Errorf("Authorize() after Update() got err = %v, want nil", err)
+	}
+}
+
+func TestSelectorLabelsFetchedOnce(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	labels := &fakeLabels{labels: map[string]string{"app": "frontend"}}
+	cfg := mountConfig("web", "default", "op://Web/a/password", "op://Web/b/password")
+	if err := NewAuthorizer(p, labels, "default").Authorize(context.Background(), cfg); err != nil {
+		t.Fatalf("Authorize() failed: %v", err)
+	}
+	if labels.calls != 1 {
+		t.Errorf("PodLabels() called %d times, want 1", labels.calls)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{
+		`rules: [{vaults: [a]}]`,
+		`rules: [{namespaces: [a]}]`,
+		`rules: [{namespaces: ["[a"], vaults: [a]}]`,
+		`rules: [{namespaces: [a], vaults: [a], podSelector: "app in ("}]`,
+		`rules: [{namespaces: [a], vaults: [a], vault: [b]}]`,
+		`rules: [null]`,
+	} {
+		if _, err := Parse([]byte(in)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", in)
+		}
+	}
+}
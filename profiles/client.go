@@ -0,0 +1,243 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/1Password/connect-sdk-go/connect"
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var idPattern = regexp.MustCompile(`^[a-z0-9]{26}$`)
+
+// Client is a Connect client using its own http.Client, so that every
+// profile can have its own CA bundle and timeouts. The SDK client always uses
+// http.DefaultClient, so the read operations needed by the provider are
+// implemented here, each with a variant taking a context; all other
+// operations are served by the embedded SDK client. Vaults and items must be
+// given by ID.
+type Client struct {
+	connect.Client
+
+	url       string
+	token     credential
+	userAgent string
+	http      *http.Client
+}
+
+var _ connect.Client = &Client{}
+
+// NewClient returns a Client for the Connect server at serverURL.
+func NewClient(serverURL, token, userAgent string, httpClient *http.Client) *Client {
+	serverURL = strings.TrimRight(serverURL, "/")
+	c := &Client{
+		Client:    connect.NewClientWithUserAgent(serverURL, token, userAgent),
+		url:       serverURL,
+		userAgent: userAgent,
+		http:      httpClient,
+	}
+	c.token.set(token)
+	return c
+}
+
+// SetToken replaces the Connect token used by subsequent requests of the
+// read operations. Requests already sent keep the previous token.
+func (c *Client) SetToken(token string) {
+	c.token.set(token)
+}
+
+// Scope identifies the Connect server and token of the client. Clients with
+// the same scope can read the same items.
+func (c *Client) Scope() string {
+	return "connect " + c.url + " " + c.token.id()
+}
+
+// GetVaults implements connect.Client.
+func (c *Client) GetVaults() ([]onepassword.Vault, error) {
+	return c.GetVaultsContext(context.Background())
+}
+
+// Heartbeat checks that the Connect server is up. It does not check the
+// token.
+func (c *Client) Heartbeat(ctx context.Context) error {
+	_, err := c.get(ctx, "/heartbeat")
+	return err
+}
+
+// GetVaultsContext is GetVaults with a context for the request.
+func (c *Client) GetVaultsContext(ctx context.Context) ([]onepassword.Vault, error) {
+	var vaults []onepassword.Vault
+	err := c.getJSON(ctx, "/v1/vaults", &vaults)
+	return vaults, err
+}
+
+// GetVaultsByTitle implements connect.Client.
+func (c *Client) GetVaultsByTitle(title string) ([]onepassword.Vault, error) {
+	return c.GetVaultsByTitleContext(context.Background(), title)
+}
+
+// GetVaultsByTitleContext is GetVaultsByTitle with a context for the request.
+func (c *Client) GetVaultsByTitleContext(ctx context.Context, title string) ([]onepassword.Vault, error) {
+	var vaults []onepassword.Vault
+	err := c.getJSON(ctx, "/v1/vaults?filter="+titleFilter(title), &vaults)
+	return vaults, err
+}
+
+// GetItemByUUID implements connect.Client.
+func (c *Client) GetItemByUUID(uuid, vaultID string) (*onepassword.Item, error) {
+	return c.GetItemByUUIDContext(context.Background(), uuid, vaultID)
+}
+
+// GetItemByUUIDContext is GetItemByUUID with a context for the request.
+func (c *Client) GetItemByUUIDContext(ctx context.Context, uuid, vaultID string) (*onepassword.Item, error) {
+	if err := checkIDs(uuid, vaultID); err != nil {
+		return nil, err
+	}
+	var item onepassword.Item
+	if err := c.getJSON(ctx, fmt.Sprintf("/v1/vaults/%s/items/%s", vaultID, uuid), &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// GetItemsByTitle implements connect.Client. Like the SDK it returns full
+// items, fetching each match individually.
+func (c *Client) GetItemsByTitle(title, vaultID string) ([]onepassword.Item, error) {
+	return c.GetItemsByTitleContext(context.Background(), title, vaultID)
+}
+
+// GetItemsByTitleContext is GetItemsByTitle with a context for the requests.
+func (c *Client) GetItemsByTitleContext(ctx context.Context, title, vaultID string) ([]onepassword.Item, error) {
+	if err := checkIDs(vaultID); err != nil {
+		return nil, err
+	}
+	var summaries []onepassword.Item
+	if err := c.getJSON(ctx, fmt.Sprintf("/v1/vaults/%s/items?filter=%s", vaultID, titleFilter(title)), &summaries); err != nil {
+		return nil, err
+	}
+	items := make([]onepassword.Item, 0, len(summaries))
+	for _, s := range summaries {
+		item, err := c.GetItemByUUIDContext(ctx, s.ID, vaultID)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+	return items, nil
+}
+
+// GetFiles implements connect.Client.
+func (c *Client) GetFiles(itemID, vaultID string) ([]onepassword.File, error) {
+	return c.GetFilesContext(context.Background(), itemID, vaultID)
+}
+
+// GetFilesContext is GetFiles with a context for the request.
+func (c *Client) GetFilesContext(ctx context.Context, itemID, vaultID string) ([]onepassword.File, error) {
+	if err := checkIDs(itemID, vaultID); err != nil {
+		return nil, err
+	}
+	var files []onepassword.File
+	err := c.getJSON(ctx, fmt.Sprintf("/v1/vaults/%s/items/%s/files", vaultID, itemID), &files)
+	return files, err
+}
+
+// GetFileContent implements connect.Client.
+func (c *Client) GetFileContent(file *onepassword.File) ([]byte, error) {
+	return c.GetFileContentContext(context.Background(), file)
+}
+
+// GetFileContentContext is GetFileContent with a context for the request.
+func (c *Client) GetFileContentContext(ctx context.Context, file *onepassword.File) ([]byte, error) {
+	if content, err := file.Content(); err == nil {
+		return content, nil
+	}
+	content, err := c.get(ctx, file.ContentPath)
+	if err != nil {
+		return nil, err
+	}
+	file.SetContent(content)
+	return content, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, out interface{}) error {
+	body, err := c.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("decoding response of %s: %v", c.url, err)
+	}
+	return nil
+}
+
+// get requests path and returns the response body. Responses other than 200
+// are returned as *onepassword.Error like the SDK does. Bodies larger than the
+// size limit of ctx fail with ErrTooLarge.
+func (c *Client) get(ctx context.Context, path string) (body []byte, err error) {
+	ctx, span := tracer.Start(ctx, "HTTP GET", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", http.MethodGet),
+		attribute.String("url.full", c.url+path),
+	))
+	defer func() { endSpan(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+path, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token.get())
+	req.Header.Set("User-Agent", c.userAgent)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	body, err = readLimited(resp.Body, sizeLimit(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &onepassword.Error{}
+		if json.Unmarshal(body, e) != nil || e.Message == "" {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+		e.StatusCode = resp.StatusCode
+		return nil, e
+	}
+	return body, nil
+}
+
+func titleFilter(title string) string {
+	return url.QueryEscape(fmt.Sprintf("title eq \"%s\"", title))
+}
+
+func checkIDs(ids ...string) error {
+	for _, id := range ids {
+		if !idPattern.MatchString(id) {
+			return fmt.Errorf("%q is not a 1Password ID", id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	testVaultID = "i7qrtqvqyko35dcv6dgr4savaa"
+	testItemID  = "oi5yyo2xzgn6mh65gl3keu7a7u"
+	testFileID  = "6r65pjq33banznomn7q22sj44e"
+)
+
+// newTestServer starts a TLS Connect server and returns a client trusting it
+// through a CA bundle file.
+func newTestServer(t *testing.T) *Client {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("."))
+	})
+	mux.HandleFunc("/v1/vaults", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("filter"); got != `title eq "Production"` {
+			t.Errorf("vault filter = %q", got)
+		}
+		fmt.Fprintf(w, `[{"id": %q, "name": "Production"}]`, testVaultID)
+	})
+	mux.HandleFunc("/v1/vaults/"+testVaultID+"/items", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"id": %q, "vault": {"id": %q}}]`, testItemID, testVaultID)
+	})
+	mux.HandleFunc("/v1/vaults/"+testVaultID+"/items/"+testItemID, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id": %q, "title": "Postgres", "vault": {"id": %q}, "fields": [{"id": "password", "label": "password", "value": "hunter2"}]}`, testItemID, testVaultID)
+	})
+	mux.HandleFunc("/v1/vaults/"+testVaultID+"/items/"+testItemID+"/files", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"id": %q, "name": "ca.pem", "size": 4, "content_path": "/v1/vaults/%s/items/%s/files/%s/content"}]`, testFileID, testVaultID, testItemID, testFileID)
+	})
+	mux.HandleFunc("/v1/vaults/"+testVaultID+"/items/"+testItemID+"/files/"+testFileID+"/content", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	})
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"status": 401, "message": "Invalid token signature"}`)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	ca := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hc, err := (&Profile{CAFile: ca}).HTTPClient()
+	if err != nil {
+		t.Fatalf("HTTPClient() failed: %v", err)
+	}
+	return NewClient(ts.URL+"/", "test-token", "test", hc)
+}
+
+func TestClient(t *testing.T) {
+	c := newTestServer(t)
+
+	if err := c.Heartbeat(context.Background()); err != nil {
+		t.Errorf("Heartbeat() failed: %v", err)
+	}
+
+	vaults, err := c.GetVaultsByTitle("Production")
+	if err != nil {
+		t.Fatalf("GetVaultsByTitle() failed: %v", err)
+	}
+	if len(vaults) != 1 || vaults[0].ID != testVaultID {
+		t.Errorf("GetVaultsByTitle() = %+v, want vault %s", vaults, testVaultID)
+	}
+
+	items, err := c.GetItemsByTitle("Postgres", testVaultID)
+	if err != nil {
+		t.Fatalf("GetItemsByTitle() failed: %v", err)
+	}
+	if len(items) != 1 || len(items[0].Fields) != 1 || items[0].Fields[0].Value != "hunter2" {
+		t.Errorf("GetItemsByTitle() = %+v, want the full item", items)
+	}
+
+	files, err := c.GetFiles(testItemID, testVaultID)
+	if err != nil {
+		t.Fatalf("GetFiles() failed: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("GetFiles() returned %d files, want 1", len(files))
+	}
+	content, err := c.GetFileContent(&files[0])
+	if err != nil {
+		t.Fatalf("GetFileContent() failed: %v", err)
+	}
+	if diff := cmp.Diff("data", string(content)); diff != "" {
+		t.Errorf("GetFileContent() returned unexpected content (-want +got):\n%s", diff)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	c := newTestServer(t)
+
+	_, err := c.GetItemByUUID("zzzzzzzzzzzzzzzzzzzzzzzzzz", testVaultID)
+	var opErr *onepassword.Error
+	if !errors.As(err, &opErr) || opErr.StatusCode != http.StatusNotFound {
+		t.Errorf("GetItemByUUID() of a missing item got err = %v, want a 404 *onepassword.Error", err)
+	}
+
+	c.SetToken("wrong")
+	_, err = c.GetVaultsByTitle("Production")
+	if !errors.As(err, &opErr) || opErr.StatusCode != http.StatusUnauthorized || opErr.Message != "Invalid token signature" {
+		t.Errorf("GetVaultsByTitle() with a wrong token got err = %v, want a 401 *onepassword.Error", err)
+	}
+
+	if _, err := c.GetItemByUUID(testItemID, "Production"); err == nil {
+		t.Errorf("GetItemByUUID() with a vault title succeeded, want error")
+	}
+}
+
+func TestClientUntrustedCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	hc, err := (&Profile{}).HTTPClient()
+	if err != nil {
+		t.Fatalf("HTTPClient() failed: %v", err)
+	}
+	if _, err := NewClient(ts.URL, "token", "test", hc).GetVaults(); err == nil {
+		t.Errorf("GetVaults() against an untrusted server succeeded, want error")
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := newTestServer(t).GetItemByUUIDContext(ctx, testItemID, testVaultID); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetItemByUUIDContext() with a canceled context got err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestClientSizeLimit(t *testing.T) {
+	c := newTestServer(t)
+	files, err := c.GetFiles(testItemID, testVaultID)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("GetFiles() = %v, %v, want one file", files, err)
+	}
+
+	if _, err := c.GetFileContentContext(WithSizeLimit(context.Background(), 3), &files[0]); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("GetFileContentContext() of 4 bytes with a limit of 3 got err = %v, want %v", err, ErrTooLarge)
+	}
+	content, err := c.GetFileContentContext(WithSizeLimit(context.Background(), 4), &files[0])
+	if err != nil || string(content) != "data" {
+		t.Errorf("GetFileContentContext() of 4 bytes with a limit of 4 = %q, %v, want the content", content, err)
+	}
+}
+
+func TestClientTracing(t *testing.T) {
+	c := newTestServer(t)
+	if _, err := c.GetItemByUUIDContext(context.Background(), testItemID, testVaultID); err != nil {
+		t.Fatalf("GetItemByUUIDContext() failed: %v", err)
+	}
+	if _, err := c.GetItemByUUIDContext(context.Background(), "zzzzzzzzzzzzzzzzzzzzzzzzzz", testVaultID); err == nil {
+		t.Fatalf("GetItemByUUIDContext() of a missing item succeeded")
+	}
+
+	codes := make(map[string]int64)
+	for _, s := range testSpans.Ended() {
+		var url string
+		var code int64
+		for _, kv := range s.Attributes() {
+			switch kv.Key {
+			case "url.full":
+				url = kv.Value.AsString()
+			case "http.response.status_code":
+				code = kv.Value.AsInt64()
+			}
+		}
+		if s.Name() == "HTTP GET" && strings.HasPrefix(url, c.url) {
+			codes[strings.TrimPrefix(url, c.url)] = code
+		}
+		attrs := s.Attributes()
+		for _, e := range s.Events() {
+			attrs = append(attrs, e.Attributes...)
+		}
+		for _, kv := range attrs {
+			if strings.Contains(kv.Value.Emit(), "hunter2") || strings.Contains(kv.Value.Emit(), "test-token") {
+				t.Errorf("span %s records a secret in %s", s.Name(), kv.Key)
+			}
+		}
+	}
+	want := map[string]int64{
+		"/v1/vaults/" + testVaultID + "/items/" + testItemID:              200,
+		"/v1/vaults/" + testVaultID + "/items/zzzzzzzzzzzzzzzzzzzzzzzzzz": 404,
+	}
+	if diff := cmp.Diff(want, codes); diff != "" {
+		t.Errorf("HTTP spans have unexpected status codes (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package profiles holds the named 1Password Connect servers and service
+// accounts the provider can fetch secrets from.
+package profiles
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultTimeout is the request timeout of profiles that do not set one.
+const DefaultTimeout = 30 * time.Second
+
+// Profile types.
+const (
+	// TypeConnect profiles read items from a 1Password Connect server.
+	TypeConnect = "connect"
+	// TypeServiceAccount profiles read items with a 1Password service
+	// account token.
+	TypeServiceAccount = "serviceAccount"
+)
+
+var namePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Config is the content of the provider config file.
+type Config struct {
+	// Default is the profile used by SecretProviderClasses without a
+	// "connect" attribute. It may be omitted if there is only one profile.
+	Default string `yaml:"default,omitempty"`
+	// Profiles maps profile names to Connect servers and service accounts.
+	Profiles map[string]*Profile `yaml:"profiles"`
+}
+
+// Profile describes how to reach one Connect server or service account.
+type Profile struct {
+	// Type is TypeConnect, the default, or TypeServiceAccount.
+	Type string `yaml:"type,omitempty"`
+	// URL of the Connect server, e.g. http://onepassword-connect:8080. Not
+	// used by service accounts.
+	URL string `yaml:"url,omitempty"`
+	// TokenEnv is the environment variable holding the Connect or service
+	// account token.
+	TokenEnv string `yaml:"tokenEnv,omitempty"`
+	// TokenFile is the file holding the Connect or service account token.
+	TokenFile string `yaml:"tokenFile,omitempty"`
+	// CLI is the path of the 1Password CLI run for service accounts.
+	// Defaults to DefaultCLI looked up in PATH.
+	CLI string `yaml:"cli,omitempty"`
+	// CAFile is an optional PEM bundle of the CAs trusted for the Connect
+	// server instead of the system roots.
+	CAFile string `yaml:"caFile,omitempty"`
+	// Timeout limits each request to the Connect server, including reading
+	// the response, or each run of the CLI. Defaults to DefaultTimeout.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// DialTimeout limits establishing the connection to the Connect server.
+	DialTimeout time.Duration `yaml:"dialTimeout,omitempty"`
+}
+
+// Parse parses and validates a provider config file.
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("invalid provider config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid provider config: %v", err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the profiles of c and fills in the default profile.
+func (c *Config) Validate() error {
+	if len(c.Profiles) == 0 {
+		return errors.New("no profiles")
+	}
+	for _, name := range c.Names() {
+		if !namePattern.MatchString(name) {
+			return fmt.Errorf("invalid profile name %q, must consist of lower case letters, digits and '-'", name)
+		}
+		if err := c.Profiles[name].validate(); err != nil {
+			return fmt.Errorf("profiles[%s]: %v", name, err)
+		}
+	}
+	if c.Default == "" {
+		if len(c.Profiles) > 1 {
+			return errors.New("default is required with more than one profile")
+		}
+		c.Default = c.Names()[0]
+	}
+	if _, ok := c.Profiles[c.Default]; !ok {
+		return fmt.Errorf("default profile %q does not exist", c.Default)
+	}
+	return nil
+}
+
+func (p *Profile) validate() error {
+	if p == nil {
+		return errors.New("empty profile")
+	}
+	switch p.Type {
+	case "", TypeConnect:
+		if err := validateURL(p.URL); err != nil {
+			return err
+		}
+		if p.CLI != "" {
+			return errors.New("cli is only supported by service accounts")
+		}
+	case TypeServiceAccount:
+		if p.URL != "" || p.CAFile != "" || p.DialTimeout != 0 {
+			return errors.New("url, caFile and dialTimeout are not supported by service accounts")
+		}
+	default:
+		return fmt.Errorf("unknown type %q, must be %s or %s", p.Type, TypeConnect, TypeServiceAccount)
+	}
+	if (p.TokenEnv == "") == (p.TokenFile == "") {
+		return errors.New("exactly one of tokenEnv and tokenFile is required")
+	}
+	if p.Timeout < 0 || p.DialTimeout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	return nil
+}
+
+// validateURL checks that u is an absolute http or https URL.
+func validateURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("url %q must be an absolute http or https URL", u)
+	}
+	return nil
+}
+
+// Names returns the sorted profile names.
+func (c *Config) Names() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsServiceAccount reports whether the profile uses a service account.
+func (p *Profile) IsServiceAccount() bool {
+	return p.Type == TypeServiceAccount
+}
+
+// Token reads the Connect or service account token of the profile.
+func (p *Profile) Token() (string, error) {
+	if p.TokenFile != "" {
+		b, err := os.ReadFile(p.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read token file: %v", err)
+		}
+		return fileToken(p.TokenFile, b)
+	}
+	token := strings.TrimSpace(os.Getenv(p.TokenEnv))
+	if token == "" {
+		return "", fmt.Errorf("environment variable %s is empty", p.TokenEnv)
+	}
+	return token, nil
+}
+
+// fileToken returns the token in data, the content of the token file path.
+func fileToken(path string, data []byte) (string, error) {
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// HTTPClient returns an http.Client honouring the CA bundle and timeouts of
+// the profile.
+func (p *Profile) HTTPClient() (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if p.DialTimeout > 0 {
+		tr.DialContext = (&net.Dialer{Timeout: p.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if p.CAFile != "" {
+		pem, err := os.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s contains no certificates", p.CAFile)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return &http.Client{Transport: tr, Timeout: timeout}, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParse(t *testing.T) {
+	in := `
+default: main
+profiles:
+  main:
+    url: http://onepassword-connect:8080
+    tokenEnv: CONNECT_TOKEN
+  finance:
+    url: https://connect.finance.example.com
+    tokenFile: /var/run/secrets/finance/token
+    caFile: /etc/finance/ca.crt
+    timeout: 15s
+    dialTimeout: 2s
+  cloud:
+    type: serviceAccount
+    tokenEnv: OP_SERVICE_ACCOUNT_TOKEN
+    cli: /usr/local/bin/op
+`
+	got, err := Parse([]byte(in))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	want := &Config{
+		Default: "main",
+		Profiles: map[string]*Profile{
+			"main":    {URL: "http://onepassword-connect:8080", TokenEnv: "CONNECT_TOKEN"},
+			"finance": {URL: "https://connect.finance.example.com", TokenFile: "/var/run/secrets/finance/token", CAFile: "/etc/finance/ca.crt", Timeout: 15 * time.Second, DialTimeout: 2 * time.Second},
+			"cloud":   {Type: TypeServiceAccount, TokenEnv: "OP_SERVICE_ACCOUNT_TOKEN", CLI: "/usr/local/bin/op"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Parse() returned unexpected config (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseSingleProfileDefault(t *testing.T) {
+	got, err := Parse([]byte("profiles: {only: {url: 'http://connect:8080', tokenEnv: T}}"))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	if got.Default != "only" {
+		t.Errorf("Parse() default = %q, want %q", got.Default, "only")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{
+		"profiles: {}",
+		"profiles: {a: {url: 'http://a', tokenEnv: T}, b: {url: 'http://b', tokenEnv: T}}",
+		"default: c\nprofiles: {a: {url: 'http://a', tokenEnv: T}}",
+		"profiles: {Main: {url: 'http://a', tokenEnv: T}}",
+		"profiles: {a: {url: 'connect:8080', tokenEnv: T}}",
+		"profiles: {a: {url: 'http://a'}}",
+		"profiles: {a: {url: 'http://a', tokenEnv: T, tokenFile: /t}}",
+		"profiles: {a: {url: 'http://a', tokenEnv: T, timeout: -1s}}",
+		"profiles: {a: {url: 'http://a', tokenEnv: T, token: secret}}",
+		"profiles: {a: null}",
+		"profiles: {a: {type: vault, url: 'http://a', tokenEnv: T}}",
+		"profiles: {a: {url: 'http://a', tokenEnv: T, cli: op}}",
+		"profiles: {a: {type: serviceAccount, url: 'http://a', tokenEnv: T}}",
+		"profiles: {a: {type: serviceAccount, caFile: /ca.crt, tokenEnv: T}}",
+		"profiles: {a: {type: serviceAccount}}",
+	} {
+		if _, err := Parse([]byte(in)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_CONNECT_TOKEN", "env-token")
+
+	for _, tc := range []struct {
+		profile *Profile
+		want    string
+	}{
+		{&Profile{TokenFile: path}, "file-token"},
+		{&Profile{TokenEnv: "TEST_CONNECT_TOKEN"}, "env-token"},
+	} {
+		got, err := tc.profile.Token()
+		if err != nil {
+			t.Errorf("Token() failed: %v", err)
+		}
+		if got != tc.want {
+			t.Errorf("Token() = %q, want %q", got, tc.want)
+		}
+	}
+
+	if _, err := (&Profile{TokenEnv: "TEST_CONNECT_TOKEN_UNSET"}).Token(); err == nil {
+		t.Errorf("Token() of an unset variable succeeded, want error")
+	}
+	if _, err := (&Profile{TokenFile: filepath.Join(t.TempDir(), "missing")}).Token(); err == nil {
+		t.Errorf("Token() of a missing file succeeded, want error")
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	c, err := (&Profile{}).HTTPClient()
+	if err != nil {
+		t.Fatalf("HTTPClient() failed: %v", err)
+	}
+	if c.Timeout != DefaultTimeout {
+		t.Errorf("HTTPClient() timeout = %v, want %v", c.Timeout, DefaultTimeout)
+	}
+
+	bad := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(bad, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Profile{CAFile: bad}).HTTPClient(); err == nil {
+		t.Errorf("HTTPClient() with an invalid CA bundle succeeded, want error")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	t.Setenv("TEST_CONNECT_TOKEN", "token")
+	cfg, err := Parse([]byte(`
+default: main
+profiles:
+  main: {url: 'http://main:8080', tokenEnv: TEST_CONNECT_TOKEN}
+  finance: {url: 'http://finance:8080', tokenEnv: TEST_CONNECT_TOKEN}
+  cloud: {type: serviceAccount, tokenEnv: TEST_CONNECT_TOKEN, cli: /bin/op}
+`))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	r, err := Load(cfg, "test")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"cloud", "finance", "main"}, r.Names(), cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("Names() returned unexpected names (-want +got):\n%s", diff)
+	}
+
+	def, err := r.Client("")
+	if err != nil {
+		t.Fatalf("Client(\"\") failed: %v", err)
+	}
+	if def.(*Client).url != "http://main:8080" {
+		t.Errorf("Client(\"\") url = %q, want the default profile", def.(*Client).url)
+	}
+	fin, err := r.Client("finance")
+	if err != nil {
+		t.Fatalf("Client(finance) failed: %v", err)
+	}
+	if fin.(*Client).url != "http://finance:8080" {
+		t.Errorf("Client(finance) url = %q, want the finance profile", fin.(*Client).url)
+	}
+	if _, err := r.Client("missing"); err == nil {
+		t.Errorf("Client(missing) succeeded, want error")
+	}
+
+	own, err := r.ClientWithToken("finance", "", "team-token")
+	if err != nil {
+		t.Fatalf("ClientWithToken() failed: %v", err)
+	}
+	if c := own.(*Client); c.url != "http://finance:8080" || c.token.get() != "team-token" {
+		t.Errorf("ClientWithToken() = (%q, %q), want the finance URL and the team token", c.url, c.token.get())
+	}
+
+	sa, err := r.ServiceAccount("cloud")
+	if err != nil {
+		t.Fatalf("ServiceAccount(cloud) failed: %v", err)
+	}
+	if sa.cli != "/bin/op" || sa.token.get() != "token" || sa.timeout != DefaultTimeout {
+		t.Errorf("ServiceAccount(cloud) = (%q, %q, %v), want the cloud profile", sa.cli, sa.token.get(), sa.timeout)
+	}
+	if sa, err := r.ServiceAccountWithToken("cloud", "team-token"); err != nil || sa.token.get() != "team-token" {
+		t.Errorf("ServiceAccountWithToken() = %v, %v, want the team token", sa, err)
+	}
+	if _, err := r.Client("cloud"); err == nil {
+		t.Errorf("Client(cloud) succeeded, want error for a service account profile")
+	}
+	if _, err := r.ServiceAccount(""); err == nil {
+		t.Errorf("ServiceAccount(\"\") succeeded, want error for a Connect profile")
+	}
+}
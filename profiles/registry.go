@@ -0,0 +1,195 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/1Password/connect-sdk-go/connect"
+)
+
+// Registry holds the Connect or service account client of every profile.
+type Registry struct {
+	defaultName string
+	userAgent   string
+	entries     map[string]*entry
+}
+
+type entry struct {
+	profile *Profile
+	// token is the token of the profile currently in use.
+	token          string
+	http           *http.Client
+	client         connect.Client
+	serviceAccount *ServiceAccountClient
+}
+
+// NewRegistry returns an empty Registry whose default profile is defaultName.
+func NewRegistry(defaultName, userAgent string) *Registry {
+	return &Registry{
+		defaultName: defaultName,
+		userAgent:   userAgent,
+		entries:     make(map[string]*entry),
+	}
+}
+
+// Load creates the clients of all profiles of cfg.
+func Load(cfg *Config, userAgent string) (*Registry, error) {
+	r := NewRegistry(cfg.Default, userAgent)
+	for _, name := range cfg.Names() {
+		p := cfg.Profiles[name]
+		token, err := p.Token()
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		if p.IsServiceAccount() {
+			r.entries[name] = &entry{
+				profile:        p,
+				token:          token,
+				serviceAccount: NewServiceAccountClient(p.CLI, token, p.Timeout),
+			}
+			continue
+		}
+		hc, err := p.HTTPClient()
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		r.entries[name] = &entry{
+			profile: p,
+			token:   token,
+			http:    hc,
+			client:  NewClient(p.URL, token, userAgent, hc),
+		}
+	}
+	return r, nil
+}
+
+// Register adds or replaces the Connect profile name with the given client.
+func (r *Registry) Register(name string, p *Profile, client connect.Client) error {
+	hc, err := p.HTTPClient()
+	if err != nil {
+		return err
+	}
+	r.entries[name] = &entry{profile: p, http: hc, client: client}
+	return nil
+}
+
+// Default returns the name of the default profile.
+func (r *Registry) Default() string {
+	return r.defaultName
+}
+
+// Names returns the sorted profile names.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile returns the profile name, or the default profile if name is empty.
+func (r *Registry) Profile(name string) (*Profile, error) {
+	e, err := r.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.profile, nil
+}
+
+// Client returns the Connect client of the profile name, or of the default
+// profile if name is empty.
+func (r *Registry) Client(name string) (connect.Client, error) {
+	e, err := r.connectEntry(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.client, nil
+}
+
+// ClientWithToken returns a client for the profile name that uses token
+// instead of the profile's token, and serverURL instead of the profile's URL
+// if set. The CA bundle and timeouts of the profile apply.
+func (r *Registry) ClientWithToken(name, serverURL, token string) (connect.Client, error) {
+	e, err := r.connectEntry(name)
+	if err != nil {
+		return nil, err
+	}
+	if serverURL == "" {
+		serverURL = e.profile.URL
+	}
+	return NewClient(serverURL, token, r.userAgent, e.http), nil
+}
+
+// ServiceAccount returns the client of the service account profile name, or
+// of the default profile if name is empty.
+func (r *Registry) ServiceAccount(name string) (*ServiceAccountClient, error) {
+	e, err := r.serviceAccountEntry(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.serviceAccount, nil
+}
+
+// ServiceAccountWithToken returns a client for the service account profile
+// name that uses token instead of the profile's token.
+func (r *Registry) ServiceAccountWithToken(name, token string) (*ServiceAccountClient, error) {
+	e, err := r.serviceAccountEntry(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewServiceAccountClient(e.profile.CLI, token, e.profile.Timeout), nil
+}
+
+func (r *Registry) connectEntry(name string) (*entry, error) {
+	e, err := r.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if e.client == nil {
+		return nil, fmt.Errorf("profile %q is a service account, not a Connect server", r.resolve(name))
+	}
+	return e, nil
+}
+
+func (r *Registry) serviceAccountEntry(name string) (*entry, error) {
+	e, err := r.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if e.serviceAccount == nil {
+		return nil, fmt.Errorf("profile %q is a Connect server, not a service account", r.resolve(name))
+	}
+	return e, nil
+}
+
+func (r *Registry) entry(name string) (*entry, error) {
+	name = r.resolve(name)
+	e, ok := r.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown Connect profile %q, available profiles: %v", name, r.Names())
+	}
+	return e, nil
+}
+
+func (r *Registry) resolve(name string) string {
+	if name == "" {
+		return r.defaultName
+	}
+	return name
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/infra"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"k8s.io/klog/v2"
+)
+
+var meter = otel.Meter("github.com/meisterlabs/secrets-store-csi-driver-provider-1password/profiles")
+
+var tokenReloads, _ = meter.Int64Counter("onepassword.token.reloads",
+	metric.WithDescription("Reloads of profile tokens from their token files, by profile and result."))
+
+// credential holds a token that can be replaced while requests use it.
+type credential struct {
+	token atomic.Pointer[string]
+}
+
+func (c *credential) get() string {
+	if t := c.token.Load(); t != nil {
+		return *t
+	}
+	return ""
+}
+
+func (c *credential) set(token string) {
+	c.token.Store(&token)
+}
+
+// id returns a hash identifying the current token without revealing it.
+func (c *credential) id() string {
+	sum := sha256.Sum256([]byte(c.get()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// tokenSetter is implemented by the clients whose token can be replaced.
+type tokenSetter interface {
+	SetToken(token string)
+}
+
+// WatchTokens reloads the token of every profile with a tokenFile whenever the
+// file changes, checking every interval until ctx is done. Requests in flight
+// keep the token they started with. Empty token files are logged and the
+// previous token stays in use.
+func (r *Registry) WatchTokens(ctx context.Context, interval time.Duration) {
+	for _, name := range r.Names() {
+		e := r.entries[name]
+		var setter tokenSetter
+		if e.serviceAccount != nil {
+			setter = e.serviceAccount
+		} else if s, ok := e.client.(tokenSetter); ok {
+			setter = s
+		}
+		if e.profile.TokenFile == "" || setter == nil {
+			continue
+		}
+		go e.watchToken(ctx, name, interval, setter)
+	}
+}
+
+// watchToken reloads the token of e from its token file. Token files that
+// cannot be read or hold no token count as failed reloads.
+func (e *entry) watchToken(ctx context.Context, name string, interval time.Duration, setter tokenSetter) {
+	path := e.profile.TokenFile
+	failed := func() {
+		tokenReloads.Add(ctx, 1, metric.WithAttributes(attribute.String("profile", name), attribute.String("result", "failure")))
+	}
+	infra.WatchFile(ctx, path, interval, nil, func(data []byte) {
+		token, err := fileToken(path, data)
+		if err != nil {
+			klog.ErrorS(err, "unable to reload token, keeping the previous token", "profile", name)
+			failed()
+			return
+		}
+		if token == e.token {
+			return
+		}
+		e.token = token
+		setter.SetToken(token)
+		klog.InfoS("reloaded token", "profile", name, "path", path)
+		tokenReloads.Add(ctx, 1, metric.WithAttributes(attribute.String("profile", name), attribute.String("result", "success")))
+	}, func(error) {
+		failed()
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/internal/metrictest"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// testMetrics collects the metrics recorded by the tests of the package.
+var testMetrics = sdkmetric.NewManualReader()
+
+// waitFor polls cond until it holds or a timeout expires.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWatchTokens(t *testing.T) {
+	dir := t.TempDir()
+	connectToken := filepath.Join(dir, "connect-token")
+	saToken := filepath.Join(dir, "sa-token")
+	for path, token := range map[string]string{connectToken: "connect-1\n", saToken: "sa-1"} {
+		if err := os.WriteFile(path, []byte(token), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := Load(&Config{
+		Default: "main",
+		Profiles: map[string]*Profile{
+			"main":  {URL: "http://connect.invalid", TokenFile: connectToken},
+			"cloud": {Type: TypeServiceAccount, TokenFile: saToken},
+		},
+	}, "test")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	client, _ := r.Client("main")
+	sa, _ := r.ServiceAccount("cloud")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.WatchTokens(ctx, time.Millisecond)
+
+	success := []attribute.KeyValue{attribute.String("profile", "main"), attribute.String("result", "success")}
+	failure := []attribute.KeyValue{attribute.String("profile", "main"), attribute.String("result", "failure")}
+
+	if err := os.WriteFile(connectToken, []byte("connect-2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(saToken, []byte("sa-2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the Connect token to be reloaded", func() bool { return client.(*Client).token.get() == "connect-2" })
+	waitFor(t, "the service account token to be reloaded", func() bool { return sa.token.get() == "sa-2" })
+	waitFor(t, "the reload to be counted", func() bool { return metrictest.Value(t, testMetrics, "onepassword.token.reloads", success...) == 1 })
+
+	// An empty file keeps the previous token.
+	if err := os.WriteFile(connectToken, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the failed reload to be counted", func() bool { return metrictest.Value(t, testMetrics, "onepassword.token.reloads", failure...) == 1 })
+	if got := client.(*Client).token.get(); got != "connect-2" {
+		t.Errorf("token after an empty token file = %q, want %q", got, "connect-2")
+	}
+
+	// So does a token file that cannot be read.
+	if err := os.Remove(connectToken); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the missing token file to be counted", func() bool { return metrictest.Value(t, testMetrics, "onepassword.token.reloads", failure...) > 1 })
+	if got := client.(*Client).token.get(); got != "connect-2" {
+		t.Errorf("token after removing the token file = %q, want %q", got, "connect-2")
+	}
+}
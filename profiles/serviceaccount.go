@@ -0,0 +1,258 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultCLI is the 1Password CLI used by service account profiles that do
+// not set one.
+const DefaultCLI = "op"
+
+// ServiceAccountClient reads items with a 1Password service account token.
+// Service accounts talk to 1Password.com with an end-to-end encrypted
+// protocol that is only implemented by 1Password's own tools, so the client
+// runs the 1Password CLI. Vaults and items must be given by ID.
+type ServiceAccountClient struct {
+	cli     string
+	token   credential
+	timeout time.Duration
+}
+
+// NewServiceAccountClient returns a client running the CLI at cli with token.
+// Every CLI invocation is limited to timeout.
+func NewServiceAccountClient(cli, token string, timeout time.Duration) *ServiceAccountClient {
+	if cli == "" {
+		cli = DefaultCLI
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	c := &ServiceAccountClient{cli: cli, timeout: timeout}
+	c.token.set(token)
+	return c
+}
+
+// SetToken replaces the service account token used by subsequent runs of the
+// CLI. Runs already started keep the previous token.
+func (c *ServiceAccountClient) SetToken(token string) {
+	c.token.set(token)
+}
+
+// cliItem is an item as printed by the CLI, which uses different keys for
+// the timestamps than Connect.
+type cliItem struct {
+	onepassword.Item
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Scope identifies the service account token of the client. Clients with the
+// same scope can read the same items.
+func (c *ServiceAccountClient) Scope() string {
+	return "serviceAccount " + c.token.id()
+}
+
+// ListVaults returns the vaults the service account has access to.
+func (c *ServiceAccountClient) ListVaults(ctx context.Context) ([]onepassword.Vault, error) {
+	var vaults []onepassword.Vault
+	err := c.runJSON(ctx, &vaults, "vault", "list")
+	return vaults, err
+}
+
+// FindVaults returns the vaults named title.
+func (c *ServiceAccountClient) FindVaults(ctx context.Context, title string) ([]onepassword.Vault, error) {
+	vaults, err := c.ListVaults(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []onepassword.Vault
+	for _, v := range vaults {
+		if v.Name == title {
+			out = append(out, v)
+		}
+	}
+	return out, nil
+}
+
+// GetItem returns the item itemID of the vault vaultID.
+func (c *ServiceAccountClient) GetItem(ctx context.Context, vaultID, itemID string) (*onepassword.Item, error) {
+	if err := checkIDs(itemID, vaultID); err != nil {
+		return nil, err
+	}
+	var item cliItem
+	if err := c.runJSON(ctx, &item, "item", "get", itemID, "--vault", vaultID); err != nil {
+		return nil, err
+	}
+	item.Item.CreatedAt = item.CreatedAt
+	item.Item.UpdatedAt = item.UpdatedAt
+	return &item.Item, nil
+}
+
+// FindItems returns the items of the vault vaultID titled title, fetching
+// each match individually.
+func (c *ServiceAccountClient) FindItems(ctx context.Context, vaultID, title string) ([]onepassword.Item, error) {
+	if err := checkIDs(vaultID); err != nil {
+		return nil, err
+	}
+	var summaries []cliItem
+	if err := c.runJSON(ctx, &summaries, "item", "list", "--vault", vaultID); err != nil {
+		return nil, err
+	}
+	var items []onepassword.Item
+	for _, s := range summaries {
+		if s.Title != title {
+			continue
+		}
+		item, err := c.GetItem(ctx, vaultID, s.ID)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+	return items, nil
+}
+
+// ListFiles returns the file attachments of the item itemID. The CLI has no
+// command listing them, so it gets the whole item; callers that already have
+// the item should take its Files instead.
+func (c *ServiceAccountClient) ListFiles(ctx context.Context, vaultID, itemID string) ([]onepassword.File, error) {
+	item, err := c.GetItem(ctx, vaultID, itemID)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]onepassword.File, 0, len(item.Files))
+	for _, f := range item.Files {
+		files = append(files, *f)
+	}
+	return files, nil
+}
+
+// GetFileContent downloads file of the item itemID.
+func (c *ServiceAccountClient) GetFileContent(ctx context.Context, vaultID, itemID string, file *onepassword.File) ([]byte, error) {
+	if content, err := file.Content(); err == nil {
+		return content, nil
+	}
+	if err := checkIDs(itemID, vaultID); err != nil {
+		return nil, err
+	}
+	content, err := c.run(ctx, "read", "--no-newline", fmt.Sprintf("op://%s/%s/%s", vaultID, itemID, file.ID))
+	if err != nil {
+		return nil, err
+	}
+	file.SetContent(content)
+	return content, nil
+}
+
+func (c *ServiceAccountClient) runJSON(ctx context.Context, out interface{}, args ...string) error {
+	stdout, err := c.run(ctx, append(args, "--format", "json")...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(stdout, out); err != nil {
+		return fmt.Errorf("decoding output of %s %s: %v", c.cli, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// run runs the CLI with args and returns its standard output, failing with
+// ErrTooLarge if it exceeds the size limit of ctx. Failures the CLI reports
+// are returned as *onepassword.Error with the HTTP status code of the
+// equivalent Connect error where one can be told from the message.
+func (c *ServiceAccountClient) run(ctx context.Context, args ...string) (out []byte, err error) {
+	// The span is named after the CLI command, its arguments are not
+	// recorded.
+	ctx, span := tracer.Start(ctx, "op "+args[0], trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{limit: sizeLimit(ctx)}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.cli, args...)
+	cmd.Env = append(cliEnv(), "OP_SERVICE_ACCOUNT_TOKEN="+c.token.get())
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%s %s: %w", c.cli, args[0], ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = exitErr.Error()
+		}
+		if code := cliStatus(msg); code != 0 {
+			return nil, &onepassword.Error{StatusCode: code, Message: msg}
+		}
+		return nil, fmt.Errorf("%s %s: %s", c.cli, args[0], msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stdout.Bytes()
+}
+
+// cliEnv returns the environment of the provider without the variables
+// configuring the CLI, e.g. OP_CONNECT_HOST, which would make it use Connect
+// instead of the service account.
+func cliEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "OP_") && !strings.HasPrefix(kv, "OP_CONFIG_DIR=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// cliStatus guesses the HTTP status code matching an error message of the
+// CLI, or returns 0 if there is none.
+func cliStatus(msg string) int {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "isn't an item"), strings.Contains(lower, "isn't a vault"),
+		strings.Contains(lower, "not found"), strings.Contains(lower, "no item found"):
+		return http.StatusNotFound
+	case strings.Contains(lower, "unauthorized"), strings.Contains(lower, "authentication"),
+		strings.Contains(lower, "invalid token"), strings.Contains(lower, "service account token"):
+		return http.StatusUnauthorized
+	case strings.Contains(lower, "forbidden"), strings.Contains(lower, "permission"):
+		return http.StatusForbidden
+	case strings.Contains(lower, "too many requests"), strings.Contains(lower, "rate limit"):
+		return http.StatusTooManyRequests
+	case strings.Contains(lower, "connection refused"), strings.Contains(lower, "no such host"),
+		strings.Contains(lower, "i/o timeout"), strings.Contains(lower, "service unavailable"):
+		return http.StatusServiceUnavailable
+	default:
+		return 0
+	}
+}
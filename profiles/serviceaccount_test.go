@@ -0,0 +1,231 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// fakeCLIEnv names the file of canned responses that turns the test binary
+// into a stand-in for the 1Password CLI.
+const fakeCLIEnv = "PROFILES_TEST_FAKE_CLI"
+
+// cliResponse is the canned result of one CLI invocation.
+type cliResponse struct {
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+// testSpans records the spans of the tests of the package.
+var testSpans = tracetest.NewSpanRecorder()
+
+func TestMain(m *testing.M) {
+	if path := os.Getenv(fakeCLIEnv); path != "" {
+		os.Exit(fakeCLI(path, os.Args[1:]))
+	}
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(testMetrics)))
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(testSpans)))
+	os.Exit(m.Run())
+}
+
+// fakeCLI answers the invocation args from the responses in path. It only
+// accepts the service account token "test-token" and fails if any Connect
+// settings leak into its environment.
+func fakeCLI(path string, args []string) int {
+	if os.Getenv("OP_SERVICE_ACCOUNT_TOKEN") != "test-token" {
+		fmt.Fprintln(os.Stderr, "[ERROR] authentication failed: invalid service account token")
+		return 1
+	}
+	if os.Getenv("OP_CONNECT_HOST") != "" {
+		fmt.Fprintln(os.Stderr, "[ERROR] OP_CONNECT_HOST is set")
+		return 1
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var responses map[string]cliResponse
+	if err := json.Unmarshal(data, &responses); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp, ok := responses[strings.Join(args, " ")]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "[ERROR] unknown command %q\n", strings.Join(args, " "))
+		return 1
+	}
+	fmt.Fprint(os.Stdout, resp.Stdout)
+	if resp.Stderr != "" {
+		fmt.Fprintln(os.Stderr, resp.Stderr)
+		return 1
+	}
+	return 0
+}
+
+// opOutput returns the output of the 1Password CLI recorded in
+// testdata/op/name. The recordings keep the keys and layout of op 2.x, which
+// differ from Connect, e.g. snake_case timestamps and sections of fields.
+func opOutput(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "op", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// newTestServiceAccount returns a client running the test binary as a fake
+// CLI with canned responses. Only the exact command lines the client is
+// expected to run are answered.
+func newTestServiceAccount(t *testing.T, token string) *ServiceAccountClient {
+	t.Helper()
+	missingItemID := "zzzzzzzzzzzzzzzzzzzzzzzzzz"
+	responses := map[string]cliResponse{
+		"vault list --format json":                                                   {Stdout: opOutput(t, "vault-list.json")},
+		fmt.Sprintf("item list --vault %s --format json", testVaultID):               {Stdout: opOutput(t, "item-list.json")},
+		fmt.Sprintf("item get %s --vault %s --format json", testItemID, testVaultID): {Stdout: opOutput(t, "item-get.json")},
+		fmt.Sprintf("item get %s --vault %s --format json", missingItemID, testVaultID): {
+			Stderr: fmt.Sprintf(`[ERROR] 2023/06/07 08:09:10 %q isn't an item in the %q vault. Specify the item with its UUID, name, or domain.`, missingItemID, testVaultID),
+		},
+		fmt.Sprintf("read --no-newline op://%s/%s/%s", testVaultID, testItemID, testFileID): {Stdout: "data"},
+	}
+	data, err := json.Marshal(responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "responses.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(fakeCLIEnv, path)
+	t.Setenv("OP_CONNECT_HOST", "http://connect.invalid")
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServiceAccountClient(exe, token, 10*time.Second)
+}
+
+func TestServiceAccountClient(t *testing.T) {
+	c := newTestServiceAccount(t, "test-token")
+
+	vaults, err := c.FindVaults(context.Background(), "Production")
+	if err != nil {
+		t.Fatalf("FindVaults() failed: %v", err)
+	}
+	if len(vaults) != 1 || vaults[0].ID != testVaultID {
+		t.Errorf("FindVaults() = %+v, want vault %s", vaults, testVaultID)
+	}
+
+	items, err := c.FindItems(context.Background(), testVaultID, "Postgres")
+	if err != nil {
+		t.Fatalf("FindItems() failed: %v", err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("FindItems() returned %d items, want 1", len(items))
+	}
+	item := items[0]
+	if item.ID != testItemID || item.Category != onepassword.Database || item.Version != 3 || item.Vault.ID != testVaultID {
+		t.Errorf("FindItems() returned unexpected item %+v", item)
+	}
+	if want := time.Date(2023, 6, 7, 8, 9, 10, 123456000, time.UTC); !item.UpdatedAt.Equal(want) {
+		t.Errorf("FindItems() updated at = %v, want %v", item.UpdatedAt, want)
+	}
+	type field struct {
+		ID, Section, Type, Purpose, Label, Value string
+	}
+	var fields []field
+	for _, f := range item.Fields {
+		var section string
+		if f.Section != nil {
+			section = f.Section.ID
+		}
+		fields = append(fields, field{f.ID, section, string(f.Type), string(f.Purpose), f.Label, f.Value})
+	}
+	wantFields := []field{
+		{"username", "", "STRING", "", "username", "admin"},
+		{"password", "", "CONCEALED", "PASSWORD", "password", "hunter2"},
+		{"notesPlain", "", "STRING", "NOTES", "notesPlain", ""},
+		{"hnkgrrnmdf4ro5vnl5ddbzqrz4", "u7wpqw5mxmhclmfbnkvl7qe6wy", "STRING", "", "host", "db-1.internal"},
+		{"TOTP_x5rbqbbhhnvuaqcnqfrdyoi5dq", "add more", "OTP", "", "one-time password", "otpauth://totp/Postgres?secret=JBSWY3DPEHPK3PXP&issuer=Example"},
+	}
+	if diff := cmp.Diff(wantFields, fields); diff != "" {
+		t.Errorf("FindItems() returned unexpected fields (-want +got):\n%s", diff)
+	}
+	if len(item.Sections) != 2 || item.Sections[1].Label != "replica" {
+		t.Errorf("FindItems() returned sections %+v, want the replica section", item.Sections)
+	}
+
+	files, err := c.ListFiles(context.Background(), testVaultID, testItemID)
+	if err != nil {
+		t.Fatalf("ListFiles() failed: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != "ca.pem" {
+		t.Fatalf("ListFiles() = %+v, want ca.pem", files)
+	}
+	content, err := c.GetFileContent(context.Background(), testVaultID, testItemID, &files[0])
+	if err != nil {
+		t.Fatalf("GetFileContent() failed: %v", err)
+	}
+	if diff := cmp.Diff([]byte("data"), content); diff != "" {
+		t.Errorf("GetFileContent() returned unexpected content (-want +got):\n%s", diff)
+	}
+}
+
+func TestServiceAccountClientErrors(t *testing.T) {
+	c := newTestServiceAccount(t, "test-token")
+
+	var opErr *onepassword.Error
+	_, err := c.GetItem(context.Background(), testVaultID, "zzzzzzzzzzzzzzzzzzzzzzzzzz")
+	if !errors.As(err, &opErr) || opErr.StatusCode != http.StatusNotFound {
+		t.Errorf("GetItem() of a missing item got err = %v, want status 404", err)
+	}
+	if _, err := c.GetItem(context.Background(), "Production", testItemID); err == nil {
+		t.Errorf("GetItem() with a vault title succeeded, want error")
+	}
+
+	file := &onepassword.File{ID: testFileID, Name: "ca.pem"}
+	if _, err := c.GetFileContent(WithSizeLimit(context.Background(), 3), testVaultID, testItemID, file); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("GetFileContent() of 4 bytes with a limit of 3 got err = %v, want %v", err, ErrTooLarge)
+	}
+
+	_, err = newTestServiceAccount(t, "wrong-token").ListVaults(context.Background())
+	if !errors.As(err, &opErr) || opErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("ListVaults() with a wrong token got err = %v, want status 401", err)
+	}
+
+	_, err = NewServiceAccountClient(filepath.Join(t.TempDir(), "op"), "test-token", 0).ListVaults(context.Background())
+	if err == nil || errors.As(err, &opErr) {
+		t.Errorf("ListVaults() with a missing CLI got err = %v, want exec error", err)
+	}
+}
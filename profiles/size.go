@@ -0,0 +1,86 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrTooLarge is returned by reads whose response exceeds the size limit of
+// their context.
+var ErrTooLarge = errors.New("response exceeds the size limit")
+
+type sizeLimitKey struct{}
+
+// WithSizeLimit returns a context limiting the responses of the reads made
+// with it to limit bytes. Reads stop once the limit is exceeded, so larger
+// responses are never held in memory. A limit of zero or less means no limit.
+func WithSizeLimit(ctx context.Context, limit int64) context.Context {
+	return context.WithValue(ctx, sizeLimitKey{}, limit)
+}
+
+// sizeLimit returns the size limit of ctx, zero if there is none.
+func sizeLimit(ctx context.Context) int64 {
+	limit, _ := ctx.Value(sizeLimitKey{}).(int64)
+	return limit
+}
+
+// readLimited reads r up to limit bytes and fails with ErrTooLarge if it has
+// more. A limit of zero or less reads all of r.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+// limitedBuffer collects up to limit bytes written to it and discards the
+// rest, remembering that it did. Writes never fail, so that processes
+// writing to it are not blocked. A limit of zero or less collects all.
+type limitedBuffer struct {
+	limit    int64
+	data     []byte
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit > 0 {
+		if room := b.limit - int64(len(b.data)); int64(len(p)) > room {
+			p = p[:max(room, 0)]
+			b.overflow = true
+		}
+	}
+	b.data = append(b.data, p...)
+	return n, nil
+}
+
+// Bytes returns the collected data, or ErrTooLarge if more than limit bytes
+// were written.
+func (b *limitedBuffer) Bytes() ([]byte, error) {
+	if b.overflow {
+		return nil, ErrTooLarge
+	}
+	return b.data, nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// AuditLog writes an event for every mount, including the mounts of rotations
+// and mounts that are denied or invalid, as a line of JSON. Events record
+// which pod read which items and fields; they never contain the values of
+// fields or files, nor error messages, which may quote them. The reasons of
+// failures are logged by klog.
+type AuditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAuditLog returns an AuditLog writing to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// Outcomes of mounts.
+const (
+	// outcomeAllowed mounts fetched their secrets, successfully or not.
+	outcomeAllowed = "allowed"
+	// outcomeDenied mounts were denied by the access policy.
+	outcomeDenied = "denied"
+	// outcomeInvalid mounts were rejected before any secret was fetched,
+	// for example for an invalid SecretProviderClass.
+	outcomeInvalid = "invalid"
+)
+
+// auditEvent is the record of a mount. Its methods may be called on a nil
+// event, which records nothing.
+type auditEvent struct {
+	Time       time.Time     `json:"time"`
+	Event      string        `json:"event"`
+	Pod        auditPod      `json:"pod"`
+	TargetPath string        `json:"targetPath"`
+	Profile    string        `json:"profile,omitempty"`
+	Secrets    []auditSecret `json:"secrets"`
+	// Items are the items the mount read, with the versions it saw.
+	Items []auditItem `json:"items"`
+	// Outcome is one of outcomeAllowed, outcomeDenied and outcomeInvalid.
+	Outcome string `json:"outcome"`
+	// Result is the gRPC status code of the mount.
+	Result         string  `json:"result"`
+	LatencySeconds float64 `json:"latencySeconds"`
+
+	start time.Time
+}
+
+type auditPod struct {
+	Namespace      string `json:"namespace"`
+	Name           string `json:"name"`
+	UID            string `json:"uid,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+}
+
+type auditSecret struct {
+	Path string `json:"path"`
+	// References are the secret references the secret was built from, more
+	// than one for templates.
+	References []string `json:"references"`
+	Section    string   `json:"section,omitempty"`
+	Field      string   `json:"field,omitempty"`
+	File       string   `json:"file,omitempty"`
+	// Stale is set if the secret was built from data of earlier mounts while
+	// the backend was unavailable.
+	Stale bool `json:"stale,omitempty"`
+	// Result is the gRPC status code of the secret, empty if the mount was
+	// rejected before it was fetched.
+	Result string `json:"result,omitempty"`
+}
+
+type auditItem struct {
+	VaultID string `json:"vaultId"`
+	ItemID  string `json:"itemId"`
+	Title   string `json:"title"`
+	Version int    `json:"version"`
+	// Stale is set if the item was served from earlier mounts while the
+	// backend was unavailable.
+	Stale bool `json:"stale,omitempty"`
+}
+
+type auditEventKey struct{}
+
+// withAuditEvent returns a context carrying e, for handleMountEvent to record
+// the secrets and items of the mount in.
+func withAuditEvent(ctx context.Context, e *auditEvent) context.Context {
+	return context.WithValue(ctx, auditEventKey{}, e)
+}
+
+// auditEventFrom returns the event of ctx, nil if there is none.
+func auditEventFrom(ctx context.Context) *auditEvent {
+	e, _ := ctx.Value(auditEventKey{}).(*auditEvent)
+	return e
+}
+
+// newAuditEvent returns the event of a mount of targetPath started at start.
+// It is invalid until the mount proves otherwise.
+func newAuditEvent(start time.Time, targetPath string) *auditEvent {
+	return &auditEvent{
+		Time:       start.UTC(),
+		Event:      "mount",
+		TargetPath: targetPath,
+		Secrets:    []auditSecret{},
+		Items:      []auditItem{},
+		Outcome:    outcomeInvalid,
+		start:      start,
+	}
+}
+
+// setPod records the pod of the mount.
+func (e *auditEvent) setPod(pod *config.PodInfo) {
+	if e == nil || pod == nil {
+		return
+	}
+	e.Pod = auditPod{
+		Namespace:      pod.Namespace,
+		Name:           pod.Name,
+		UID:            string(pod.UID),
+		ServiceAccount: pod.ServiceAccount,
+	}
+}
+
+// setConfig records the pod, profile and secrets of the mount of cfg.
+func (e *auditEvent) setConfig(cfg *config.MountConfig) {
+	if e == nil {
+		return
+	}
+	e.setPod(cfg.PodInfo)
+	e.Profile = cfg.Profile
+	e.Secrets = make([]auditSecret, len(cfg.Secrets))
+	for i, secret := range cfg.Secrets {
+		s := auditSecret{
+			Path:    secret.PathString(),
+			Section: secret.Section,
+			Field:   secret.Field,
+			File:    secret.File,
+		}
+		if secret.Reference != nil {
+			s.References = append(s.References, secret.Reference.String())
+		}
+		for _, ref := range secret.TemplateRefs {
+			s.References = append(s.References, ref.String())
+		}
+		sort.Strings(s.References)
+		e.Secrets[i] = s
+	}
+}
+
+// setOutcome records the outcome of the mount.
+func (e *auditEvent) setOutcome(outcome string) {
+	if e != nil {
+		e.Outcome = outcome
+	}
+}
+
+// fetched records the results of the secrets of the mount and the items it
+// read: the items seen by its snapshot and, marked stale, the items served
+// from the stale store instead.
+func (e *auditEvent) fetched(errs []error, servedStale []bool, seen []*onepassword.Item, staleItems []*onepassword.Item) {
+	if e == nil {
+		return
+	}
+	for i := range e.Secrets {
+		e.Secrets[i].Result = status.Code(errs[i]).String()
+		e.Secrets[i].Stale = servedStale[i]
+	}
+	key := func(item *onepassword.Item) string {
+		return fmt.Sprintf("%q", []string{item.Vault.ID, item.ID})
+	}
+	keys := make(map[string]bool, len(seen))
+	for _, item := range seen {
+		keys[key(item)] = true
+		e.Items = append(e.Items, auditItem{VaultID: item.Vault.ID, ItemID: item.ID, Title: item.Title, Version: item.Version})
+	}
+	sort.Slice(staleItems, func(i, j int) bool { return key(staleItems[i]) < key(staleItems[j]) })
+	for _, item := range staleItems {
+		if keys[key(item)] {
+			continue
+		}
+		keys[key(item)] = true
+		e.Items = append(e.Items, auditItem{VaultID: item.Vault.ID, ItemID: item.ID, Title: item.Title, Version: item.Version, Stale: true})
+	}
+}
+
+// finish completes e with the result of the mount.
+func (e *auditEvent) finish(err error) {
+	e.Result = status.Code(err).String()
+	e.LatencySeconds = time.Since(e.start).Seconds()
+}
+
+// record writes e to the log. Failures are logged and do not fail the mount.
+func (a *AuditLog) record(e *auditEvent) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		klog.ErrorS(err, "unable to encode audit event")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		klog.ErrorS(err, "unable to write audit event", "pod", klog.ObjectRef{Namespace: e.Pod.Namespace, Name: e.Pod.Name})
+	}
+}
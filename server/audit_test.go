@@ -0,0 +1,209 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/connect"
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/policy"
+	"sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1"
+)
+
+// auditEvents decodes the events of an audit log.
+func auditEvents(t *testing.T, log string) []auditEvent {
+	t.Helper()
+	if strings.Contains(log, "hunter2") {
+		t.Errorf("audit log contains a secret value:\n%s", log)
+	}
+	var events []auditEvent
+	for _, line := range strings.Split(strings.TrimSpace(log), "\n") {
+		var e auditEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("audit event %s is not JSON: %v", line, err)
+		}
+		if e.Time.IsZero() || e.LatencySeconds <= 0 {
+			t.Errorf("audit event %s has no time or latency", line)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestMountAudit(t *testing.T) {
+	var buf bytes.Buffer
+	item := testItem()
+	item.Version = 7
+	s := &Server{
+		Clients: testRegistry(t, map[string]connect.Client{"default": newFakeClient(item)}),
+		Audit:   NewAuditLog(&buf),
+	}
+	const targetPath = "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/secrets/mount"
+	mount := func(secrets, permission string) error {
+		attributes, err := json.Marshal(map[string]string{
+			"secrets":                                secrets,
+			"csi.storage.k8s.io/pod.namespace":       "default",
+			"csi.storage.k8s.io/pod.name":            "test-pod",
+			"csi.storage.k8s.io/pod.uid":             "uid",
+			"csi.storage.k8s.io/serviceAccount.name": "app",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Mount(context.Background(), &v1alpha1.MountRequest{
+			Attributes: string(attributes),
+			Secrets:    "{}",
+			TargetPath: targetPath,
+			Permission: permission,
+		})
+		return err
+	}
+	const secrets = "- resourceName: op://Production/Postgres/password\n  path: password\n- resourceName: op://Production/Postgres\n  path: item.json\n"
+
+	if err := mount(secrets, "420"); err != nil {
+		t.Fatalf("Mount() failed: %v", err)
+	}
+	if err := mount(secrets+"- resourceName: op://Production/Postgres/missing\n  path: missing\n", "420"); err == nil {
+		t.Fatalf("Mount() of a missing field succeeded")
+	}
+	if err := mount(secrets, "rw"); err == nil {
+		t.Fatalf("Mount() with invalid permissions succeeded")
+	}
+	if err := mount("- path: nothing\n", "420"); err == nil {
+		t.Fatalf("Mount() of an invalid secret succeeded")
+	}
+	p, err := policy.Parse([]byte(`rules: [{namespaces: [payments], vaults: [Production]}]`))
+	if err != nil {
+		t.Fatalf("policy.Parse() failed: %v", err)
+	}
+	s.Authorizer = policy.NewAuthorizer(p, nil, "default")
+	if err := mount(secrets, "420"); err == nil {
+		t.Fatalf("Mount() denied by the access policy succeeded")
+	}
+
+	events := auditEvents(t, buf.String())
+	if len(events) != 5 {
+		t.Fatalf("audit log has %d events, want 5:\n%s", len(events), buf.String())
+	}
+	pod := auditPod{Namespace: "default", Name: "test-pod", UID: "uid", ServiceAccount: "app"}
+	references := []auditSecret{
+		{Path: "password", References: []string{"op://Production/Postgres/password"}},
+		{Path: "item.json", References: []string{"op://Production/Postgres"}},
+	}
+	withResults := func(secrets []auditSecret, results ...string) []auditSecret {
+		out := make([]auditSecret, len(secrets))
+		for i, s := range secrets {
+			s.Result = results[i]
+			out[i] = s
+		}
+		return out
+	}
+	want := []auditEvent{{
+		Event:      "mount",
+		Pod:        pod,
+		TargetPath: targetPath,
+		Secrets:    withResults(references, "OK", "OK"),
+		Items:      []auditItem{{VaultID: testVaultID, ItemID: testItemID, Title: "Postgres", Version: 7}},
+		Outcome:    outcomeAllowed,
+		Result:     "OK",
+	}, {
+		Event:      "mount",
+		Pod:        pod,
+		TargetPath: targetPath,
+		Secrets: withResults(append(references, auditSecret{Path: "missing", References: []string{"op://Production/Postgres/missing"}}),
+			"OK", "OK", "NotFound"),
+		Items:   []auditItem{{VaultID: testVaultID, ItemID: testItemID, Title: "Postgres", Version: 7}},
+		Outcome: outcomeAllowed,
+		Result:  "Internal",
+	}, {
+		Event:      "mount",
+		Pod:        pod,
+		TargetPath: targetPath,
+		Outcome:    outcomeInvalid,
+		Result:     "InvalidArgument",
+	}, {
+		Event:      "mount",
+		Pod:        pod,
+		TargetPath: targetPath,
+		Outcome:    outcomeInvalid,
+		Result:     "InvalidArgument",
+	}, {
+		Event:      "mount",
+		Pod:        pod,
+		TargetPath: targetPath,
+		Secrets:    references,
+		Outcome:    outcomeDenied,
+		Result:     "PermissionDenied",
+	}}
+	opts := cmp.Options{
+		cmpopts.IgnoreFields(auditEvent{}, "Time", "LatencySeconds"),
+		cmpopts.IgnoreUnexported(auditEvent{}),
+		cmpopts.EquateEmpty(),
+	}
+	if diff := cmp.Diff(want, events, opts); diff != "" {
+		t.Errorf("audit events of mounts (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandleMountEventAuditStale(t *testing.T) {
+	store, err := NewStaleStore(time.Hour)
+	if err != nil {
+		t.Fatalf("NewStaleStore() failed: %v", err)
+	}
+	s := &Server{Stale: store}
+	item := testItem()
+	item.Version = 3
+	backend := &testBackend{Backend: newFakeBackend(item), scope: "team"}
+	cfg := &config.MountConfig{
+		Secrets: []*config.Secret{
+			secret(t, "op://Production/Postgres/password", "password"),
+			secret(t, "op://Production/Postgres/username", "username"),
+		},
+		Permissions: 777,
+		PodInfo:     &config.PodInfo{Namespace: "default", Name: "test-pod"},
+	}
+	mount := func() *auditEvent {
+		event := newAuditEvent(time.Now(), "")
+		event.setConfig(cfg)
+		if _, err := s.handleMountEvent(withAuditEvent(context.Background(), event), backend, cfg); err != nil {
+			t.Fatalf("handleMountEvent() failed: %v", err)
+		}
+		return event
+	}
+
+	if diff := cmp.Diff([]auditItem{{VaultID: testVaultID, ItemID: testItemID, Title: "Postgres", Version: 3}}, mount().Items); diff != "" {
+		t.Errorf("audited items of a mount (-want +got):\n%s", diff)
+	}
+	backend.fail(&onepassword.Error{StatusCode: http.StatusInternalServerError})
+	event := mount()
+	if diff := cmp.Diff([]auditItem{{VaultID: testVaultID, ItemID: testItemID, Title: "Postgres", Version: 3, Stale: true}}, event.Items); diff != "" {
+		t.Errorf("audited items of a stale mount (-want +got):\n%s", diff)
+	}
+	for _, secret := range event.Secrets {
+		if !secret.Stale {
+			t.Errorf("audited secret %s of a stale mount is not marked stale", secret.Path)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/1Password/connect-sdk-go/connect"
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/profiles"
+)
+
+// Backend reads vaults, items and file attachments from 1Password. Vaults and
+// items are given by ID. Errors carrying an HTTP status code are returned as
+// *onepassword.Error. Calls return early with the error of ctx once it is
+// done.
+type Backend interface {
+	// ListVaults returns all vaults the backend has access to.
+	ListVaults(ctx context.Context) ([]onepassword.Vault, error)
+	// FindVaults returns the vaults named title.
+	FindVaults(ctx context.Context, title string) ([]onepassword.Vault, error)
+	// GetItem returns the item itemID of the vault vaultID.
+	GetItem(ctx context.Context, vaultID, itemID string) (*onepassword.Item, error)
+	// FindItems returns the items of the vault vaultID titled title.
+	FindItems(ctx context.Context, vaultID, title string) ([]onepassword.Item, error)
+	// ListFiles returns the file attachments of the item itemID.
+	ListFiles(ctx context.Context, vaultID, itemID string) ([]onepassword.File, error)
+	// GetFileContent downloads a file returned by ListFiles.
+	GetFileContent(ctx context.Context, vaultID, itemID string, file *onepassword.File) ([]byte, error)
+}
+
+// heartbeater is implemented by backends and clients that can check whether
+// their server is up without credentials.
+type heartbeater interface {
+	Heartbeat(ctx context.Context) error
+}
+
+// scopedBackend gives a wrapped Backend the scope of the backend it wraps.
+type scopedBackend struct {
+	Backend
+	scope string
+}
+
+// Scope implements scoper.
+func (b *scopedBackend) Scope() string {
+	return b.scope
+}
+
+// keepScope returns the wrapper w of b with the scope of b, if it has one, so
+// that the cache and stale store still apply to w.
+func keepScope(b, w Backend) Backend {
+	if s, ok := b.(scoper); ok {
+		return &scopedBackend{Backend: w, scope: s.Scope()}
+	}
+	return w
+}
+
+// contextClient is implemented by Connect clients with read operations taking
+// a context. The calls of other clients cannot be aborted; the backend stops
+// waiting for them when the context is done.
+type contextClient interface {
+	GetVaultsContext(ctx context.Context) ([]onepassword.Vault, error)
+	GetVaultsByTitleContext(ctx context.Context, title string) ([]onepassword.Vault, error)
+	GetItemByUUIDContext(ctx context.Context, uuid, vaultID string) (*onepassword.Item, error)
+	GetItemsByTitleContext(ctx context.Context, title, vaultID string) ([]onepassword.Item, error)
+	GetFilesContext(ctx context.Context, itemID, vaultID string) ([]onepassword.File, error)
+	GetFileContentContext(ctx context.Context, file *onepassword.File) ([]byte, error)
+}
+
+var (
+	_ Backend       = &connectBackend{}
+	_ Backend       = &profiles.ServiceAccountClient{}
+	_ contextClient = &profiles.Client{}
+)
+
+// connectBackend is a Backend reading from a 1Password Connect server.
+type connectBackend struct {
+	client connect.Client
+}
+
+// NewConnectBackend returns a Backend using the Connect client.
+func NewConnectBackend(client connect.Client) Backend {
+	return &connectBackend{client: client}
+}
+
+// Scope implements scoper. Clients that cannot name their credentials are
+// scoped to the client instance.
+func (b *connectBackend) Scope() string {
+	if s, ok := b.client.(scoper); ok {
+		return s.Scope()
+	}
+	return fmt.Sprintf("connect %p", b.client)
+}
+
+// Heartbeat implements heartbeater. Clients without a heartbeat are assumed
+// to be up.
+func (b *connectBackend) Heartbeat(ctx context.Context) error {
+	if h, ok := b.client.(heartbeater); ok {
+		return h.Heartbeat(ctx)
+	}
+	return nil
+}
+
+func (b *connectBackend) ListVaults(ctx context.Context) ([]onepassword.Vault, error) {
+	if c, ok := b.client.(contextClient); ok {
+		return c.GetVaultsContext(ctx)
+	}
+	return callContext(ctx, b.client.GetVaults)
+}
+
+func (b *connectBackend) FindVaults(ctx context.Context, title string) ([]onepassword.Vault, error) {
+	if c, ok := b.client.(contextClient); ok {
+		return c.GetVaultsByTitleContext(ctx, title)
+	}
+	return callContext(ctx, func() ([]onepassword.Vault, error) {
+		return b.client.GetVaultsByTitle(title)
+	})
+}
+
+func (b *connectBackend) GetItem(ctx context.Context, vaultID, itemID string) (*onepassword.Item, error) {
+	if c, ok := b.client.(contextClient); ok {
+		return c.GetItemByUUIDContext(ctx, itemID, vaultID)
+	}
+	return callContext(ctx, func() (*onepassword.Item, error) {
+		return b.client.GetItemByUUID(itemID, vaultID)
+	})
+}
+
+func (b *connectBackend) FindItems(ctx context.Context, vaultID, title string) ([]onepassword.Item, error) {
+	if c, ok := b.client.(contextClient); ok {
+		return c.GetItemsByTitleContext(ctx, title, vaultID)
+	}
+	return callContext(ctx, func() ([]onepassword.Item, error) {
+		return b.client.GetItemsByTitle(title, vaultID)
+	})
+}
+
+func (b *connectBackend) ListFiles(ctx context.Context, vaultID, itemID string) ([]onepassword.File, error) {
+	if c, ok := b.client.(contextClient); ok {
+		return c.GetFilesContext(ctx, itemID, vaultID)
+	}
+	return callContext(ctx, func() ([]onepassword.File, error) {
+		return b.client.GetFiles(itemID, vaultID)
+	})
+}
+
+func (b *connectBackend) GetFileContent(ctx context.Context, vaultID, itemID string, file *onepassword.File) ([]byte, error) {
+	if c, ok := b.client.(contextClient); ok {
+		return c.GetFileContentContext(ctx, file)
+	}
+	return callContext(ctx, func() ([]byte, error) {
+		return b.client.GetFileContent(file)
+	})
+}
+
+// callContext returns the result of call, or the error of ctx if it is done
+// first. The call keeps running in the background until it returns.
+func callContext[T any](ctx context.Context, call func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := call()
+		done <- result{v, err}
+	}()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/sync/singleflight"
+)
+
+var meter = otel.Meter("github.com/meisterlabs/secrets-store-csi-driver-provider-1password/server")
+
+var cacheLookups, _ = meter.Int64Counter("onepassword.cache.lookups",
+	metric.WithDescription("Lookups in the item cache, by operation and result (hit, miss or shared)."))
+
+// Cache is a node-local LRU cache of vault and item lookups shared by all
+// mounts. Entries are keyed by the credentials of the backend that fetched
+// them, so a mount is only ever served data its own token could read.
+// Concurrent lookups of the same key share a single backend call. File
+// contents are not cached.
+type Cache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	group   singleflight.Group
+
+	// clock returns the current time, time.Now if nil.
+	clock func() time.Time
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// NewCache returns a Cache keeping entries for ttl and at most maxEntries
+// entries, evicting the least recently used ones first.
+func NewCache(ttl time.Duration, maxEntries int) *Cache {
+	return &Cache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// scoper is implemented by backends and clients that can name the
+// credentials they use. Backends with the same scope can read the same items.
+type scoper interface {
+	Scope() string
+}
+
+// Backend returns b with its vault and item lookups served from the cache.
+// Backends that cannot name their credentials are returned unchanged.
+func (c *Cache) Backend(b Backend) Backend {
+	s, ok := b.(scoper)
+	if !ok {
+		return b
+	}
+	return &cachedBackend{Backend: b, cache: c, scope: s.Scope()}
+}
+
+type cachedKey struct{}
+
+// withCachedMark returns a context in which the lookups answered from a Cache
+// or a snapshot instead of the backend set *cached, see markCached.
+func withCachedMark(ctx context.Context, cached *bool) context.Context {
+	return context.WithValue(ctx, cachedKey{}, cached)
+}
+
+// markCached records in ctx that a lookup was answered without calling the
+// backend, so that its result is not mistaken for fresh data.
+func markCached(ctx context.Context) {
+	if cached, ok := ctx.Value(cachedKey{}).(*bool); ok {
+		*cached = true
+	}
+}
+
+func (c *Cache) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+	return time.Now()
+}
+
+// maxSharedFetch bounds shared calls of callers without a deadline.
+const maxSharedFetch = time.Minute
+
+// get returns the value cached for key or calls fetch, sharing the call with
+// concurrent callers of the same key. Errors are not cached. The shared call
+// is not canceled when a caller gives up, so that it still fills the cache for
+// the others, but it keeps the deadline of the caller that started it, or
+// maxSharedFetch if it has none, so retries and waits for limits stay bounded.
+func (c *Cache) get(ctx context.Context, op, key string, fetch func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if v, ok := c.lookup(key); ok {
+		cacheLookups.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", op), attribute.String("result", "hit")))
+		markCached(ctx)
+		return v, nil
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(maxSharedFetch)
+	}
+	fetched := false
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		// A call for the same key may have finished since the lookup.
+		if v, ok := c.lookup(key); ok {
+			return v, nil
+		}
+		fetched = true
+		shared, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+		defer cancel()
+		v, err := fetch(shared)
+		if err == nil {
+			c.store(key, v)
+		}
+		return v, err
+	})
+	select {
+	case r := <-ch:
+		result := "miss"
+		if r.Shared {
+			result = "shared"
+		}
+		if !fetched {
+			markCached(ctx)
+		}
+		cacheLookups.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", op), attribute.String("result", result)))
+		return r.Val, r.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Cache) lookup(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *Cache) store(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &cacheEntry{key: key, value: value, expires: c.now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cachedBackend serves the vault and item lookups of a Backend from a Cache.
+// Items returned from the cache are shared and must not be modified.
+type cachedBackend struct {
+	Backend
+	cache *Cache
+	scope string
+}
+
+// Scope implements scoper.
+func (b *cachedBackend) Scope() string {
+	return b.scope
+}
+
+func (b *cachedBackend) key(parts ...string) string {
+	return fmt.Sprintf("%s\x00%q", b.scope, parts)
+}
+
+func (b *cachedBackend) FindVaults(ctx context.Context, title string) ([]onepassword.Vault, error) {
+	v, err := b.cache.get(ctx, "find_vaults", b.key("vaults", title), func(ctx context.Context) (interface{}, error) {
+		return b.Backend.FindVaults(ctx, title)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]onepassword.Vault), nil
+}
+
+func (b *cachedBackend) GetItem(ctx context.Context, vaultID, itemID string) (*onepassword.Item, error) {
+	v, err := b.cache.get(ctx, "get_item", b.key("item", vaultID, itemID), func(ctx context.Context) (interface{}, error) {
+		return b.Backend.GetItem(ctx, vaultID, itemID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*onepassword.Item), nil
+}
+
+func (b *cachedBackend) FindItems(ctx context.Context, vaultID, title string) ([]onepassword.Item, error) {
+	v, err := b.cache.get(ctx, "find_items", b.key("items", vaultID, title), func(ctx context.Context) (interface{}, error) {
+		return b.Backend.FindItems(ctx, vaultID, title)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]onepassword.Item), nil
+}
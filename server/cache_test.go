@@ -0,0 +1,150 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := NewCache(time.Minute, 10)
+	c.clock = func() time.Time { return now }
+	team := &testBackend{Backend: newFakeBackend(testItem()), scope: "team"}
+	other := &testBackend{Backend: newFakeBackend(testItem()), scope: "other"}
+
+	hits := metricValue(t, "onepassword.cache.lookups", attribute.String("operation", "get_item"), attribute.String("result", "hit"))
+	for i := 0; i < 3; i++ {
+		if _, err := c.Backend(team).GetItem(context.Background(), testVaultID, testItemID); err != nil {
+			t.Fatalf("GetItem() failed: %v", err)
+		}
+	}
+	if n := team.count("get_item"); n != 1 {
+		t.Errorf("backend called %d times for repeated lookups, want 1", n)
+	}
+	if got := metricValue(t, "onepassword.cache.lookups", attribute.String("operation", "get_item"), attribute.String("result", "hit")); got != hits+2 {
+		t.Errorf("cache hits = %d, want %d", got, hits+2)
+	}
+
+	// Other credentials never see the entries of team.
+	if _, err := c.Backend(other).GetItem(context.Background(), testVaultID, testItemID); err != nil {
+		t.Fatalf("GetItem() failed: %v", err)
+	}
+	if n := other.count("get_item"); n != 1 {
+		t.Errorf("backend with other credentials called %d times, want 1", n)
+	}
+
+	// Expired entries are fetched again.
+	now = now.Add(time.Minute)
+	if _, err := c.Backend(team).GetItem(context.Background(), testVaultID, testItemID); err != nil {
+		t.Fatalf("GetItem() failed: %v", err)
+	}
+	if n := team.count("get_item"); n != 2 {
+		t.Errorf("backend called %d times after expiry, want 2", n)
+	}
+
+	// Errors are not cached.
+	for i := 0; i < 2; i++ {
+		if _, err := c.Backend(team).GetItem(context.Background(), testVaultID, "zzzzzzzzzzzzzzzzzzzzzzzzzz"); err == nil {
+			t.Fatalf("GetItem() of a missing item succeeded, want error")
+		}
+	}
+	if n := team.count("get_item"); n != 4 {
+		t.Errorf("backend called %d times for failing lookups, want 4", n)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(time.Minute, 1)
+	b := &testBackend{Backend: newFakeBackend(testItem()), scope: "team"}
+	cached := c.Backend(b)
+
+	cached.GetItem(context.Background(), testVaultID, testItemID)
+	cached.FindVaults(context.Background(), "Production")
+	cached.GetItem(context.Background(), testVaultID, testItemID)
+	if n := b.count("get_item"); n != 2 {
+		t.Errorf("backend called %d times after eviction, want 2", n)
+	}
+	if len(c.entries) != 1 || c.lru.Len() != 1 {
+		t.Errorf("cache holds %d entries, want 1", len(c.entries))
+	}
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	c := NewCache(time.Minute, 10)
+	b := &testBackend{Backend: newFakeBackend(testItem()), scope: "team", block: make(chan struct{})}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.Backend(b).GetItem(context.Background(), testVaultID, testItemID)
+		}(i)
+	}
+	// Wait for the first lookup to reach the backend before releasing it so
+	// the others are collapsed into it or served from the cache.
+	for b.count("get_item") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(b.block)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("GetItem() failed: %v", err)
+		}
+	}
+	if n := b.count("get_item"); n != 1 {
+		t.Errorf("backend called %d times for concurrent lookups, want 1", n)
+	}
+}
+
+func TestCacheSharedDeadline(t *testing.T) {
+	c := NewCache(time.Minute, 10)
+	b := &testBackend{Backend: newFakeBackend(testItem()), scope: "team"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	if _, err := c.Backend(b).GetItem(ctx, testVaultID, testItemID); err != nil {
+		t.Fatalf("GetItem() failed: %v", err)
+	}
+	if !b.lastDeadline().Equal(want) {
+		t.Errorf("shared lookup had deadline %v, want the deadline of the caller %v", b.lastDeadline(), want)
+	}
+
+	c = NewCache(time.Minute, 10)
+	if _, err := c.Backend(b).GetItem(context.Background(), testVaultID, testItemID); err != nil {
+		t.Fatalf("GetItem() failed: %v", err)
+	}
+	if d := b.lastDeadline(); d.IsZero() || time.Until(d) > maxSharedFetch {
+		t.Errorf("shared lookup without a caller deadline had deadline %v, want at most %v from now", b.lastDeadline(), maxSharedFetch)
+	}
+}
+
+func TestCacheUnscopedBackend(t *testing.T) {
+	// Embedding the interface hides the Scope method of the backend.
+	unscoped := struct{ Backend }{newFakeBackend(testItem())}
+	if _, cached := NewCache(time.Minute, 10).Backend(unscoped).(*cachedBackend); cached {
+		t.Errorf("Backend() cached a backend without a scope")
+	}
+}
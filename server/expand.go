@@ -0,0 +1,99 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"path"
+	"strings"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// expandItem returns one file per selected field of item, named after the
+// field label.
+func expandItem(item *onepassword.Item, secret *config.Secret) ([]resultFile, error) {
+	fields := filterFields(item, secret.Include, secret.Exclude)
+	files := make([]resultFile, 0, len(fields))
+	seen := make(map[string]*onepassword.ItemField, len(fields))
+	for _, f := range fields {
+		name := fileName(f.Label, f.ID)
+		if secret.SectionDirs && f.Section != nil {
+			name = path.Join(fileName(sectionLabel(item, f), f.Section.ID), name)
+		}
+		if other, ok := seen[name]; ok {
+			return nil, status.Errorf(codes.FailedPrecondition, "fields %s and %s of item %s both expand to %q; exclude one of them or use sectionDirs", other.ID, f.ID, item.ID, name)
+		}
+		seen[name] = f
+		files = append(files, resultFile{path: name, data: []byte(f.Value)})
+	}
+	return files, nil
+}
+
+// filterFields returns the fields of item that match include (if set) and do
+// not match exclude (if set), in item order.
+func filterFields(item *onepassword.Item, include, exclude *config.FieldFilter) []*onepassword.ItemField {
+	out := make([]*onepassword.ItemField, 0, len(item.Fields))
+	for _, f := range item.Fields {
+		if include != nil && !matchesFilter(f, include) {
+			continue
+		}
+		if exclude != nil && matchesFilter(f, exclude) {
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+func matchesFilter(field *onepassword.ItemField, filter *config.FieldFilter) bool {
+	for _, t := range filter.Types {
+		if strings.EqualFold(t, string(field.Type)) {
+			return true
+		}
+	}
+	for _, l := range filter.Labels {
+		if l == field.Label || l == field.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// fileName turns a field or section label into a safe file name. Characters
+// other than letters, digits, '.', '-' and '_' are replaced by '_'. Labels
+// that are empty or consist only of dots fall back to the ID.
+func fileName(label, id string) string {
+	name := sanitize(label)
+	if strings.Trim(name, ".") == "" {
+		name = sanitize(id)
+	}
+	return name
+}
+
+func sanitize(s string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
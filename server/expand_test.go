@@ -0,0 +1,130 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestExpandItem(t *testing.T) {
+	tests := []struct {
+		name        string
+		sectionDirs bool
+		include     *config.FieldFilter
+		exclude     *config.FieldFilter
+		want        map[string]string
+		wantCode    codes.Code
+	}{
+		{
+			name:        "section dirs",
+			sectionDirs: true,
+			want: map[string]string{
+				"username":          "admin",
+				"password":          "hunter2",
+				"primary/host":      "db-0.internal",
+				"replica/host":      "db-1.internal",
+				"one-time_password": "otpauth://totp/test?secret=GEZDGNBVGY3TQOJQ",
+			},
+		},
+		{
+			name:     "colliding labels",
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:    "include by type",
+			include: &config.FieldFilter{Types: []string{"concealed"}},
+			want:    map[string]string{"password": "hunter2"},
+		},
+		{
+			name:    "include by label and exclude by id",
+			include: &config.FieldFilter{Labels: []string{"username", "host"}},
+			exclude: &config.FieldFilter{Labels: []string{"primary-host"}},
+			want:    map[string]string{"username": "admin", "host": "db-1.internal"},
+		},
+		{
+			name:    "exclude by type",
+			exclude: &config.FieldFilter{Types: []string{"STRING", "OTP"}},
+			want:    map[string]string{"password": "hunter2"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &config.Secret{Expand: true, SectionDirs: tc.sectionDirs, Include: tc.include, Exclude: tc.exclude}
+			files, err := expandItem(testItem(), s)
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("expandItem() got code %v, want %v (err = %v)", code, tc.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			got := make(map[string]string, len(files))
+			for _, f := range files {
+				got[f.path] = string(f.data)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("expandItem() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandleMountEventExpand(t *testing.T) {
+	s := secret(t, "op://Production/Postgres", "db")
+	s.Expand = true
+	s.Include = &config.FieldFilter{Labels: []string{"username", "password"}}
+	cfg := &config.MountConfig{
+		Secrets:     []*config.Secret{s},
+		Permissions: 0400,
+		PodInfo:     &config.PodInfo{Namespace: "default", Name: "test-pod"},
+	}
+
+	got, err := (&Server{}).handleMountEvent(context.Background(), newFakeBackend(testItem()), cfg)
+	if err != nil {
+		t.Fatalf("handleMountEvent() failed: %v", err)
+	}
+	var paths []string
+	for _, f := range got.GetFiles() {
+		paths = append(paths, f.GetPath())
+	}
+	if diff := cmp.Diff([]string{"db/username", "db/password"}, paths); diff != "" {
+		t.Errorf("handleMountEvent() returned unexpected files (-want +got):\n%s", diff)
+	}
+	if n := len(got.GetObjectVersion()); n != 1 {
+		t.Errorf("handleMountEvent() returned %d object versions, want 1", n)
+	}
+}
+
+func TestFileName(t *testing.T) {
+	tests := map[string]string{
+		"password":          "password",
+		"one-time password": "one-time_password",
+		"../etc/passwd":     ".._etc_passwd",
+		"..":                "fallback",
+		"":                  "fallback",
+		"Schlüssel":         "Schl_ssel",
+	}
+	for label, want := range tests {
+		if got := fileName(label, "fallback"); got != want {
+			t.Errorf("fileName(%q) = %q, want %q", label, got, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/profiles"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fetchFile downloads the file attachment of item with the given name or ID.
+func (s *Server) fetchFile(ctx context.Context, client Backend, vaultID string, item *onepassword.Item, name string) ([]byte, error) {
+	files, err := client.ListFiles(ctx, vaultID, item.ID)
+	if err != nil {
+		return nil, statusErr(err, "unable to list files of item %s", item.ID)
+	}
+	file, err := selectFile(item, files, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.fileContent(ctx, client, vaultID, item, file)
+}
+
+// fetchDocument downloads the file of a Document item.
+func (s *Server) fetchDocument(ctx context.Context, client Backend, vaultID string, item *onepassword.Item) ([]byte, error) {
+	files, err := client.ListFiles(ctx, vaultID, item.ID)
+	if err != nil {
+		return nil, statusErr(err, "unable to list files of item %s", item.ID)
+	}
+	if len(files) == 0 {
+		return nil, status.Errorf(codes.NotFound, "document %s has no file", item.ID)
+	}
+	return s.fileContent(ctx, client, vaultID, item, &files[0])
+}
+
+// selectFile returns the file of files with the given ID or name. It fails if
+// the name is ambiguous.
+func selectFile(item *onepassword.Item, files []onepassword.File, name string) (*onepassword.File, error) {
+	var matches []*onepassword.File
+	for i := range files {
+		if files[i].ID == name {
+			return &files[i], nil
+		}
+		if files[i].Name == name {
+			matches = append(matches, &files[i])
+		}
+	}
+	switch len(matches) {
+	case 0:
+		names := make([]string, 0, len(files))
+		for _, f := range files {
+			names = append(names, fmt.Sprintf("%q", f.Name))
+		}
+		if len(names) == 0 {
+			return nil, status.Errorf(codes.NotFound, "file %q not found, item %s has no files", name, item.ID)
+		}
+		return nil, status.Errorf(codes.NotFound, "file %q not found in item %s, available files: %s", name, item.ID, strings.Join(names, ", "))
+	case 1:
+		return matches[0], nil
+	default:
+		ids := make([]string, 0, len(matches))
+		for _, f := range matches {
+			ids = append(ids, f.ID)
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "file name %q is ambiguous in item %s, matches files %s", name, item.ID, strings.Join(ids, ", "))
+	}
+}
+
+// fileContent downloads file, enforcing the configured size limit before and
+// during the download, and after it for clients that cannot stop early.
+func (s *Server) fileContent(ctx context.Context, client Backend, vaultID string, item *onepassword.Item, file *onepassword.File) ([]byte, error) {
+	if s.MaxFileSize > 0 && int64(file.Size) > s.MaxFileSize {
+		return nil, status.Errorf(codes.FailedPrecondition, "file %q of item %s is %d bytes, exceeds the limit of %d bytes", file.Name, item.ID, file.Size, s.MaxFileSize)
+	}
+	content, err := client.GetFileContent(profiles.WithSizeLimit(ctx, s.MaxFileSize), vaultID, item.ID, file)
+	if errors.Is(err, profiles.ErrTooLarge) {
+		return nil, status.Errorf(codes.FailedPrecondition, "file %q of item %s exceeds the limit of %d bytes", file.Name, item.ID, s.MaxFileSize)
+	}
+	if err != nil {
+		return nil, statusErr(err, "unable to download file %q of item %s", file.Name, item.ID)
+	}
+	if s.MaxFileSize > 0 && int64(len(content)) > s.MaxFileSize {
+		return nil, status.Errorf(codes.FailedPrecondition, "file %q of item %s is %d bytes, exceeds the limit of %d bytes", file.Name, item.ID, len(content), s.MaxFileSize)
+	}
+	return content, nil
+}
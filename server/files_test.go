@@ -0,0 +1,103 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var keystore = []byte{0xfe, 0xed, 0xfe, 0xed, 0x00, 0x00, 0x00, 0x02, 0x00, 0xff}
+
+func testFile(id, name string, content []byte) *onepassword.File {
+	f := &onepassword.File{ID: id, Name: name, Size: len(content)}
+	f.SetContent(content)
+	return f
+}
+
+func testItemWithFiles() *onepassword.Item {
+	item := testItem()
+	item.Files = []*onepassword.File{
+		testFile("keystoreid", "keystore.jks", keystore),
+		testFile("caid", "ca.pem", []byte("-----BEGIN CERTIFICATE-----")),
+	}
+	return item
+}
+
+func testDocument() *onepassword.Item {
+	return &onepassword.Item{
+		ID:       "dddddddddddddddddddddddddd",
+		Title:    "license",
+		Vault:    onepassword.ItemVault{ID: testVaultID},
+		Category: onepassword.Document,
+		Files:    []*onepassword.File{testFile("licenseid", "license.bin", []byte{0x00, 0x01, 0x02})},
+	}
+}
+
+func TestFetchOnePasswordSecretFiles(t *testing.T) {
+	client := newFakeBackend(testItemWithFiles(), testDocument())
+
+	tests := []struct {
+		name         string
+		resourceName string
+		file         string
+		want         []byte
+	}{
+		{name: "file by name", resourceName: "op://Production/Postgres", file: "keystore.jks", want: keystore},
+		{name: "file by id", resourceName: "op://Production/Postgres", file: "caid", want: []byte("-----BEGIN CERTIFICATE-----")},
+		{name: "file in reference", resourceName: "op://Production/Postgres/ca.pem", want: []byte("-----BEGIN CERTIFICATE-----")},
+		{name: "document", resourceName: "op://Production/license", want: []byte{0x00, 0x01, 0x02}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := secret(t, tc.resourceName, "out")
+			s.File = tc.file
+			got, err := (&Server{MaxFileSize: 1024}).fetchOnePasswordSecret(context.Background(), client, s)
+			if err != nil {
+				t.Fatalf("fetchOnePasswordSecret() failed: %v", err)
+			}
+			if !bytes.Equal(got.files[0].data, tc.want) {
+				t.Errorf("fetchOnePasswordSecret() got %v, want %v", got.files[0].data, tc.want)
+			}
+		})
+	}
+}
+
+func TestFetchOnePasswordSecretFileErrors(t *testing.T) {
+	client := newFakeBackend(testItemWithFiles())
+
+	s := secret(t, "op://Production/Postgres", "out")
+	s.File = "truststore.jks"
+	_, err := (&Server{}).fetchOnePasswordSecret(context.Background(), client, s)
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("fetchOnePasswordSecret() got err = %v, want NotFound", err)
+	}
+	if !strings.Contains(err.Error(), `"keystore.jks", "ca.pem"`) {
+		t.Errorf("fetchOnePasswordSecret() got err = %v, want list of available files", err)
+	}
+
+	s.File = "keystore.jks"
+	_, err = (&Server{MaxFileSize: 4}).fetchOnePasswordSecret(context.Background(), client, s)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("fetchOnePasswordSecret() got err = %v, want FailedPrecondition for oversized file", err)
+	}
+}
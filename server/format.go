@@ -0,0 +1,252 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// keyValue is a single entry of a formatted item.
+type keyValue struct {
+	key   string
+	value string
+}
+
+// formatItem renders the selected fields of item in the format of the secret.
+func formatItem(item *onepassword.Item, secret *config.Secret) ([]byte, error) {
+	fields := filterFields(item, secret.Include, secret.Exclude)
+	kvs := make([]keyValue, 0, len(fields))
+	seen := make(map[string]*onepassword.ItemField, len(fields))
+	for _, f := range fields {
+		key := f.Label
+		if key == "" {
+			key = f.ID
+		}
+		if secret.SectionPrefix && f.Section != nil {
+			key = sectionLabel(item, f) + "." + key
+		}
+		key = normalizeKey(key, secret.KeyCase)
+		if secret.Format == config.FormatDotenv {
+			key = envKey(key)
+		}
+		if other, ok := seen[key]; ok {
+			return nil, status.Errorf(codes.FailedPrecondition, "fields %s and %s of item %s both map to key %q; exclude one of them or use sectionPrefix", other.ID, f.ID, item.ID, key)
+		}
+		seen[key] = f
+		kvs = append(kvs, keyValue{key: key, value: f.Value})
+	}
+
+	switch secret.Format {
+	case config.FormatDotenv:
+		return formatDotenv(kvs), nil
+	case config.FormatJSON:
+		return formatJSON(kvs)
+	case config.FormatYAML:
+		return formatYAML(kvs)
+	case config.FormatProperties:
+		return formatProperties(kvs), nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown format %q", secret.Format)
+	}
+}
+
+// normalizeKey converts key to the requested case. Word boundaries are
+// characters other than letters and digits as well as camelCase humps.
+func normalizeKey(key, keyCase string) string {
+	switch keyCase {
+	case config.KeyCaseUpperSnake:
+		return strings.ToUpper(strings.Join(splitWords(key), "_"))
+	case config.KeyCaseLowerSnake:
+		return strings.ToLower(strings.Join(splitWords(key), "_"))
+	default:
+		return key
+	}
+}
+
+func splitWords(s string) []string {
+	var words []string
+	var cur []rune
+	flush := func() {
+		if len(cur) > 0 {
+			words = append(words, string(cur))
+			cur = nil
+		}
+	}
+	runes := []rune(s)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+		if len(cur) > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush()
+			}
+		}
+		cur = append(cur, r)
+	}
+	flush()
+	return words
+}
+
+// envKey turns key into a valid environment variable name.
+func envKey(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// formatDotenv writes KEY="value" lines. Values are double quoted with
+// backslash, quote, dollar and backtick escaped and line breaks kept, so that
+// sourcing the file in a POSIX shell sets the values unchanged. dotenv parsers
+// following the quoting rules of the shell read the same values; others, such
+// as the dotenv packages of Node.js and Python, may keep some of the escapes.
+func formatDotenv(kvs []keyValue) []byte {
+	var b bytes.Buffer
+	r := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		`$`, `\$`,
+		"`", "\\`",
+	)
+	for _, kv := range kvs {
+		fmt.Fprintf(&b, "%s=\"%s\"\n", kv.key, r.Replace(kv.value))
+	}
+	return b.Bytes()
+}
+
+// formatJSON writes a flat JSON object, keeping the field order of the item.
+func formatJSON(kvs []keyValue) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, kv := range kvs {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		k, err := json.Marshal(kv.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(kv.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteString(":")
+		b.Write(v)
+	}
+	b.WriteString("}")
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, b.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteString("\n")
+	return out.Bytes(), nil
+}
+
+// formatYAML writes a flat YAML mapping, keeping the field order of the item.
+// All values are strings.
+func formatYAML(kvs []keyValue) ([]byte, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, kv := range kvs {
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: kv.key},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: kv.value},
+		)
+	}
+	if len(kvs) == 0 {
+		node.Style = yaml.FlowStyle
+	}
+	return yaml.Marshal(node)
+}
+
+// formatProperties writes a Java .properties file. Non-ASCII characters are
+// written as \uXXXX escapes so the file is valid in ISO 8859-1 as expected by
+// java.util.Properties.load(InputStream).
+func formatProperties(kvs []keyValue) []byte {
+	var b bytes.Buffer
+	for _, kv := range kvs {
+		b.WriteString(escapeProperty(kv.key, true))
+		b.WriteString("=")
+		b.WriteString(escapeProperty(kv.value, false))
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+func escapeProperty(s string, key bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '=', ':', '#', '!':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case ' ':
+			// Spaces separate keys from values and leading spaces of values
+			// are skipped by the parser.
+			if key || i == 0 {
+				b.WriteRune('\\')
+			}
+			b.WriteRune(r)
+		default:
+			switch {
+			case r > 0xffff:
+				r1, r2 := utf16.EncodeRune(r)
+				fmt.Fprintf(&b, `\u%04x\u%04x`, r1, r2)
+			case r < 0x20 || r > 0x7e:
+				fmt.Fprintf(&b, `\u%04x`, r)
+			default:
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/google/go-cmp/cmp"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFormatItem(t *testing.T) {
+	exclude := &config.FieldFilter{Types: []string{"OTP"}}
+	tests := []struct {
+		name   string
+		secret *config.Secret
+		want   string
+	}{
+		{
+			name:   "dotenv",
+			secret: &config.Secret{Format: config.FormatDotenv, KeyCase: config.KeyCaseUpperSnake, SectionPrefix: true, Exclude: exclude},
+			want: `USERNAME="admin"
+PASSWORD="hunter2"
+PRIMARY_HOST="db-0.internal"
+REPLICA_HOST="db-1.internal"
+`,
+		},
+		{
+			name:   "json",
+			secret: &config.Secret{Format: config.FormatJSON, SectionPrefix: true, Exclude: exclude},
+			want: `{
+  "username": "admin",
+  "password": "hunter2",
+  "primary.host": "db-0.internal",
+  "replica.host": "db-1.internal"
+}
+`,
+		},
+		{
+			name:   "yaml",
+			secret: &config.Secret{Format: config.FormatYAML, KeyCase: config.KeyCaseLowerSnake, SectionPrefix: true, Exclude: exclude},
+			want: `username: admin
+password: hunter2
+primary_host: db-0.internal
+replica_host: db-1.internal
+`,
+		},
+		{
+			name:   "properties",
+			secret: &config.Secret{Format: config.FormatProperties, SectionPrefix: true, Include: &config.FieldFilter{Labels: []string{"host"}}},
+			want: `primary.host=db-0.internal
+replica.host=db-1.internal
+`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := formatItem(testItem(), tc.secret)
+			if err != nil {
+				t.Fatalf("formatItem() failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("formatItem() returned unexpected content (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFormatItemCollision(t *testing.T) {
+	_, err := formatItem(testItem(), &config.Secret{Format: config.FormatDotenv})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("formatItem() got code %v, want %v (err = %v)", code, codes.FailedPrecondition, err)
+	}
+}
+
+func TestFormatEscaping(t *testing.T) {
+	item := &onepassword.Item{
+		ID: testItemID,
+		Fields: []*onepassword.ItemField{
+			{ID: "a", Label: "1st key", Value: "say \"hi\"\n$HOME `id` \\"},
+			{ID: "b", Label: "grüße", Value: " ä😀=#"},
+		},
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: config.FormatDotenv,
+			want:   "_1st_key=\"say \\\"hi\\\"\n\\$HOME \\`id\\` \\\\\"\ngr__e=\" ä😀=#\"\n",
+		},
+		{
+			format: config.FormatProperties,
+			want:   "1st\\ key=say \"hi\"\\n$HOME `id` \\\\\ngr\\u00fc\\u00dfe=\\ \\u00e4\\ud83d\\ude00\\=\\#\n",
+		},
+		{
+			format: config.FormatYAML,
+			want:   "1st key: |-\n    say \"hi\"\n    $HOME `id` \\\ngrüße: \" ä\\U0001F600=#\"\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.format, func(t *testing.T) {
+			got, err := formatItem(item, &config.Secret{Format: tc.format})
+			if err != nil {
+				t.Fatalf("formatItem() failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("formatItem() returned unexpected content (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFormatDotenvShell(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to source the file with")
+	}
+	values := []string{
+		"plain",
+		"say \"hi\" and 'bye'",
+		"$HOME ${HOME} $(id) `id` \\$ \\",
+		"first line\nsecond line\r\n",
+		" ä😀=# ",
+		"",
+	}
+	var kvs []keyValue
+	for i, v := range values {
+		kvs = append(kvs, keyValue{key: fmt.Sprintf("VALUE_%d", i), value: v})
+	}
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, formatDotenv(kvs), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Print the sourced values separated by NUL bytes, which cannot be part
+	// of them.
+	script := ". " + path + "\n"
+	for _, kv := range kvs {
+		script += fmt.Sprintf("printf '%%s\\0' \"$%s\"\n", kv.key)
+	}
+	out, err := exec.Command(sh, "-c", script).Output()
+	if err != nil {
+		t.Fatalf("sourcing the dotenv file failed: %v", err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	if diff := cmp.Diff(values, got); diff != "" {
+		t.Errorf("values sourced from the dotenv file differ (-want +got):\n%s", diff)
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		in, keyCase, want string
+	}{
+		{"one-time password", config.KeyCaseUpperSnake, "ONE_TIME_PASSWORD"},
+		{"notesPlain", config.KeyCaseUpperSnake, "NOTES_PLAIN"},
+		{"APIKey", config.KeyCaseLowerSnake, "api_key"},
+		{"db.host2", config.KeyCaseLowerSnake, "db_host2"},
+		{"Mixed Case", "", "Mixed Case"},
+	}
+	for _, tc := range tests {
+		if got := normalizeKey(tc.in, tc.keyCase); got != tc.want {
+			t.Errorf("normalizeKey(%q, %q) = %q, want %q", tc.in, tc.keyCase, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/profiles"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1"
+)
+
+// Backend health states.
+const (
+	// HealthUnknown is the state of backends that were not checked yet.
+	HealthUnknown = "unknown"
+	// HealthOK is the state of backends that are up and accept their
+	// credentials.
+	HealthOK = "ok"
+	// HealthUnreachable is the state of backends that cannot be reached or
+	// fail with 5xx errors.
+	HealthUnreachable = "unreachable"
+	// HealthUnauthorized is the state of backends that reject their
+	// credentials.
+	HealthUnauthorized = "unauthorized"
+	// HealthError is the state of backends failing for any other reason.
+	HealthError = "error"
+)
+
+var backendHealthy, _ = meter.Int64ObservableGauge("onepassword.backend.healthy",
+	metric.WithDescription("Whether the last health check of the backend of each profile succeeded: 1 healthy, 0 not."))
+
+// BackendStatus is the result of the latest health check of the backend of a
+// profile.
+type BackendStatus struct {
+	Type     string `json:"type"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Status   string `json:"status"`
+	// Heartbeat is "ok" or "failed" for Connect servers, empty for service
+	// accounts and when the heartbeat was not checked.
+	Heartbeat string `json:"heartbeat,omitempty"`
+	// Token is "valid" or "invalid", empty when it could not be checked.
+	Token string `json:"token,omitempty"`
+	// Vaults is the number of vaults the credentials can read.
+	Vaults int    `json:"vaults"`
+	Error  string `json:"error,omitempty"`
+
+	LastCheck      time.Time `json:"lastCheck,omitzero"`
+	LastSuccess    time.Time `json:"lastSuccess,omitzero"`
+	LatencySeconds float64   `json:"latencySeconds"`
+}
+
+// Health periodically checks that the backend of every profile is up and
+// accepts the profile's credentials. Checks bypass the limits, retries and
+// caches of mounts, so they report the state of the backend itself. Checks of
+// service accounts count against the rate limits of 1Password on every node,
+// so they are repeated less often than those of Connect servers.
+type Health struct {
+	server                 *Server
+	timeout                time.Duration
+	serviceAccountInterval time.Duration
+
+	mu       sync.Mutex
+	statuses map[string]*BackendStatus
+	// grpc are the gRPC health services the readiness is reported to.
+	grpc []*health.Server
+}
+
+// NewHealth returns a Health checking the profiles of s, giving each check
+// up to timeout. Service account profiles are checked again only once
+// serviceAccountInterval passed since their last check.
+func NewHealth(s *Server, timeout, serviceAccountInterval time.Duration) *Health {
+	h := &Health{
+		server:                 s,
+		timeout:                timeout,
+		serviceAccountInterval: serviceAccountInterval,
+		statuses:               make(map[string]*BackendStatus),
+	}
+	for _, name := range s.Clients.Names() {
+		h.statuses[name] = &BackendStatus{Status: HealthUnknown}
+	}
+	meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for name, st := range h.statuses {
+			var healthy int64
+			if st.Status == HealthOK {
+				healthy = 1
+			}
+			o.ObserveInt64(backendHealthy, healthy, metric.WithAttributes(attribute.String("profile", name)))
+		}
+		return nil
+	}, backendHealthy)
+	return h
+}
+
+// Run checks all backends every interval until ctx is done, starting right
+// away.
+func (h *Health) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		h.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Check checks the backends of all profiles once, except service accounts
+// checked less than the service account interval ago.
+func (h *Health) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, name := range h.server.Clients.Names() {
+		if h.checkedRecently(name) {
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			h.update(name, h.check(ctx, name))
+		}(name)
+	}
+	wg.Wait()
+	h.report()
+}
+
+// checkedRecently reports whether name is a service account profile checked
+// less than the service account interval ago.
+func (h *Health) checkedRecently(name string) bool {
+	p, err := h.server.Clients.Profile(name)
+	if err != nil || !p.IsServiceAccount() {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.statuses[name]
+	return ok && !st.LastCheck.IsZero() && time.Since(st.LastCheck) < h.serviceAccountInterval
+}
+
+// check checks the backend of the profile name: the heartbeat of Connect
+// servers first, then the credentials by listing the vaults.
+func (h *Health) check(ctx context.Context, name string) *BackendStatus {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	st := &BackendStatus{Type: profiles.TypeConnect, LastCheck: time.Now()}
+	defer func() { st.LatencySeconds = time.Since(st.LastCheck).Seconds() }()
+	if p, err := h.server.Clients.Profile(name); err == nil {
+		if p.IsServiceAccount() {
+			st.Type = profiles.TypeServiceAccount
+		} else {
+			st.Endpoint = p.URL
+		}
+	}
+	b, err := h.server.ProfileBackend(name)
+	if err != nil {
+		st.Status, st.Error = HealthError, err.Error()
+		return st
+	}
+
+	if hb, ok := b.(heartbeater); ok {
+		if err := hb.Heartbeat(ctx); err != nil {
+			st.Heartbeat, st.Status, st.Error = "failed", HealthUnreachable, err.Error()
+			return st
+		}
+		st.Heartbeat = "ok"
+	}
+	vaults, err := b.ListVaults(ctx)
+	if err != nil {
+		st.Status, st.Error = healthStatus(err), err.Error()
+		if st.Status == HealthUnauthorized {
+			st.Token = "invalid"
+		}
+		return st
+	}
+	st.Status, st.Token, st.Vaults = HealthOK, "valid", len(vaults)
+	st.LastSuccess = st.LastCheck
+	return st
+}
+
+// healthStatus classifies the error of a failed check.
+func healthStatus(err error) string {
+	var opErr *onepassword.Error
+	switch {
+	case errors.As(err, &opErr) && (opErr.StatusCode == http.StatusUnauthorized || opErr.StatusCode == http.StatusForbidden):
+		return HealthUnauthorized
+	case unavailable(err):
+		return HealthUnreachable
+	}
+	return HealthError
+}
+
+// update stores st as the status of the profile name and logs changes.
+func (h *Health) update(name string, st *BackendStatus) {
+	h.mu.Lock()
+	prev := h.statuses[name]
+	if prev != nil && st.Status != HealthOK {
+		st.LastSuccess = prev.LastSuccess
+	}
+	h.statuses[name] = st
+	h.mu.Unlock()
+
+	if prev != nil && prev.Status == st.Status {
+		return
+	}
+	if st.Status == HealthOK {
+		klog.InfoS("backend is healthy", "profile", name, "vaults", st.Vaults)
+		return
+	}
+	klog.ErrorS(errors.New(st.Error), "backend is not healthy, mounts are served from cached data where available", "profile", name, "status", st.Status)
+}
+
+// Statuses returns the status of the backend of every profile.
+func (h *Health) Statuses() map[string]BackendStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]BackendStatus, len(h.statuses))
+	for name, st := range h.statuses {
+		out[name] = *st
+	}
+	return out
+}
+
+// Healthy reports whether the backends of all profiles are healthy.
+func (h *Health) Healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, st := range h.statuses {
+		if st.Status != HealthOK {
+			return false
+		}
+	}
+	return true
+}
+
+// Ready reports whether the backend of the default profile is healthy.
+func (h *Health) Ready() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.statuses[h.server.Clients.Default()]
+	return ok && st.Status == HealthOK
+}
+
+// ReportTo sets the serving status of the provider service, and of the
+// server as a whole, in hs after every round of checks: SERVING while the
+// provider is ready, NOT_SERVING otherwise.
+func (h *Health) ReportTo(hs *health.Server) {
+	h.mu.Lock()
+	h.grpc = append(h.grpc, hs)
+	h.mu.Unlock()
+	h.report()
+}
+
+func (h *Health) report() {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if h.Ready() {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	h.mu.Lock()
+	servers := h.grpc
+	h.mu.Unlock()
+	for _, hs := range servers {
+		hs.SetServingStatus("", status)
+		hs.SetServingStatus(v1alpha1.CSIDriverProvider_ServiceDesc.ServiceName, status)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/connect"
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/google/go-cmp/cmp"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/profiles"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// unhealthyClient is a Connect client whose heartbeat fails with heartbeat
+// and whose vault listing fails with vaults.
+type unhealthyClient struct {
+	*fakeClient
+	heartbeat error
+	vaults    error
+}
+
+func (c *unhealthyClient) Heartbeat(ctx context.Context) error {
+	return c.heartbeat
+}
+
+func (c *unhealthyClient) GetVaults() ([]onepassword.Vault, error) {
+	if c.vaults != nil {
+		return nil, c.vaults
+	}
+	return c.fakeClient.GetVaults()
+}
+
+func TestHealth(t *testing.T) {
+	s := &Server{
+		Clients: testRegistry(t, map[string]connect.Client{
+			"default": &unhealthyClient{fakeClient: newFakeClient()},
+			"revoked": &unhealthyClient{fakeClient: newFakeClient(), vaults: &onepassword.Error{StatusCode: 401, Message: "Invalid token signature"}},
+			"down":    &unhealthyClient{fakeClient: newFakeClient(), heartbeat: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+		}),
+	}
+	h := NewHealth(s, time.Second, time.Hour)
+	if h.Ready() || h.Statuses()["default"].Status != HealthUnknown {
+		t.Errorf("Ready() = true before the first check, want false")
+	}
+
+	h.Check(context.Background())
+
+	want := map[string]BackendStatus{
+		"default": {Status: HealthOK, Heartbeat: "ok", Token: "valid", Vaults: 1},
+		"revoked": {Status: HealthUnauthorized, Heartbeat: "ok", Token: "invalid"},
+		"down":    {Status: HealthUnreachable, Heartbeat: "failed"},
+	}
+	got := h.Statuses()
+	for name, w := range want {
+		g := got[name]
+		if g.Status != w.Status || g.Heartbeat != w.Heartbeat || g.Token != w.Token || g.Vaults != w.Vaults {
+			t.Errorf("status of %s = %+v, want %+v", name, g, w)
+		}
+		if g.Type != "connect" || g.Endpoint != "http://connect.invalid" || g.LastCheck.IsZero() {
+			t.Errorf("status of %s = %+v, want the type, endpoint and time of the check", name, g)
+		}
+		if (g.Status == HealthOK) != !g.LastSuccess.IsZero() {
+			t.Errorf("status of %s has last success %v", name, g.LastSuccess)
+		}
+	}
+	if !h.Ready() {
+		t.Errorf("Ready() = false with a healthy default profile, want true")
+	}
+	if h.Healthy() {
+		t.Errorf("Healthy() = true with unhealthy profiles, want false")
+	}
+	if v := metricValue(t, "onepassword.backend.healthy", attribute.String("profile", "down")); v != 0 {
+		t.Errorf("onepassword.backend.healthy of down = %d, want 0", v)
+	}
+	if v := metricValue(t, "onepassword.backend.healthy", attribute.String("profile", "default")); v != 1 {
+		t.Errorf("onepassword.backend.healthy of default = %d, want 1", v)
+	}
+}
+
+func TestHealthKeepsLastSuccess(t *testing.T) {
+	client := &unhealthyClient{fakeClient: newFakeClient()}
+	s := &Server{Clients: testRegistry(t, map[string]connect.Client{"default": client})}
+	h := NewHealth(s, time.Second, time.Hour)
+
+	h.Check(context.Background())
+	success := h.Statuses()["default"].LastSuccess
+	client.heartbeat = &onepassword.Error{StatusCode: 503, Message: "Service Unavailable"}
+	h.Check(context.Background())
+
+	st := h.Statuses()["default"]
+	if st.Status != HealthUnreachable || !st.LastSuccess.Equal(success) {
+		t.Errorf("status after an outage = %+v, want unreachable since %v", st, success)
+	}
+	if h.Ready() {
+		t.Errorf("Ready() = true while the default profile is down, want false")
+	}
+}
+
+func TestHealthServiceAccountInterval(t *testing.T) {
+	// The CLI records every run and lists no vaults.
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	cli := filepath.Join(dir, "op")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %s\necho '[]'\n", runs)
+	if err := os.WriteFile(cli, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_OP_TOKEN", "profile-token")
+	cfg, err := profiles.Parse([]byte(fmt.Sprintf(`
+default: cloud
+profiles:
+  cloud: {type: serviceAccount, tokenEnv: TEST_OP_TOKEN, cli: %q}
+`, cli)))
+	if err != nil {
+		t.Fatalf("profiles.Parse() failed: %v", err)
+	}
+	clients, err := profiles.Load(cfg, "test")
+	if err != nil {
+		t.Fatalf("profiles.Load() failed: %v", err)
+	}
+	h := NewHealth(&Server{Clients: clients}, 10*time.Second, time.Hour)
+
+	h.Check(context.Background())
+	h.Check(context.Background())
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatalf("CLI was not run: %v", err)
+	}
+	if got := strings.Count(string(data), "\n"); got != 1 {
+		t.Errorf("CLI ran %d times in two checks within the service account interval, want 1", got)
+	}
+	if st := h.Statuses()["cloud"]; st.Status != HealthOK || st.Type != "serviceAccount" {
+		t.Errorf("status of cloud = %+v, want a healthy service account", st)
+	}
+}
+
+func TestHealthReportTo(t *testing.T) {
+	client := &unhealthyClient{fakeClient: newFakeClient()}
+	s := &Server{Clients: testRegistry(t, map[string]connect.Client{"default": client})}
+	h := NewHealth(s, time.Second, time.Hour)
+	hs := health.NewServer()
+	h.ReportTo(hs)
+
+	servingStatus := func() map[string]healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		out := make(map[string]healthpb.HealthCheckResponse_ServingStatus)
+		for _, service := range []string{"", "v1alpha1.CSIDriverProvider"} {
+			resp, err := hs.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+			if err != nil {
+				t.Fatalf("Check(%q) failed: %v", service, err)
+			}
+			out[service] = resp.GetStatus()
+		}
+		return out
+	}
+	notServing := map[string]healthpb.HealthCheckResponse_ServingStatus{"": healthpb.HealthCheckResponse_NOT_SERVING, "v1alpha1.CSIDriverProvider": healthpb.HealthCheckResponse_NOT_SERVING}
+	serving := map[string]healthpb.HealthCheckResponse_ServingStatus{"": healthpb.HealthCheckResponse_SERVING, "v1alpha1.CSIDriverProvider": healthpb.HealthCheckResponse_SERVING}
+
+	if diff := cmp.Diff(notServing, servingStatus()); diff != "" {
+		t.Errorf("serving status before the first check (-want +got):\n%s", diff)
+	}
+	h.Check(context.Background())
+	if diff := cmp.Diff(serving, servingStatus()); diff != "" {
+		t.Errorf("serving status with a healthy backend (-want +got):\n%s", diff)
+	}
+	client.vaults = &onepassword.Error{StatusCode: 401, Message: "Invalid token signature"}
+	h.Check(context.Background())
+	if diff := cmp.Diff(notServing, servingStatus()); diff != "" {
+		t.Errorf("serving status with a rejected token (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"sync"
+)
+
+// maxHostKeys bounds the number of Connect servers named by
+// nodePublishSecretRefs that are tracked at a time.
+const maxHostKeys = 256
+
+// keyed holds a value per backend key, see backendKey. The values of profiles
+// are kept for the life of the set; those of Connect servers named by
+// nodePublishSecretRefs only for the maxHostKeys most recently used servers,
+// so pods cannot make the set grow without bound.
+type keyed[T any] struct {
+	mu     sync.Mutex
+	values map[string]T
+	// hosts holds the keys of Connect servers, the most recently used first.
+	hosts *list.List
+	used  map[string]*list.Element
+}
+
+func newKeyed[T any]() *keyed[T] {
+	return &keyed[T]{
+		values: make(map[string]T),
+		hosts:  list.New(),
+		used:   make(map[string]*list.Element),
+	}
+}
+
+// get returns the value of key, calling create for keys without one.
+func (k *keyed[T]) get(key string, create func() T) T {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	v, ok := k.values[key]
+	if !ok {
+		v = create()
+		k.values[key] = v
+	}
+	if !isHostKey(key) {
+		return v
+	}
+	if el, ok := k.used[key]; ok {
+		k.hosts.MoveToFront(el)
+		return v
+	}
+	k.used[key] = k.hosts.PushFront(key)
+	for k.hosts.Len() > maxHostKeys {
+		oldest := k.hosts.Remove(k.hosts.Back()).(string)
+		delete(k.used, oldest)
+		delete(k.values, oldest)
+	}
+	return v
+}
+
+// each calls f for every key and its value.
+func (k *keyed[T]) each(f func(key string, v T)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for key, v := range k.values {
+		f(key, v)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+)
+
+func TestBackendKey(t *testing.T) {
+	key := func(url string) string {
+		return backendKey(&config.MountConfig{ConnectURL: url}, "default")
+	}
+	if got := backendKey(&config.MountConfig{}, "finance"); got != "finance" {
+		t.Errorf("backendKey() of a profile = %q, want %q", got, "finance")
+	}
+	a := key("https://connect.team-a.example.com")
+	if !isHostKey(a) || isHostKey("default") {
+		t.Errorf("isHostKey() does not tell keys of Connect servers from profiles")
+	}
+	if b := key("https://Connect.Team-A.example.com/v1/"); b != a {
+		t.Errorf("backendKey() of the same host = %q, want %q", b, a)
+	}
+	if b := key("https://connect.team-b.example.com"); b == a {
+		t.Errorf("backendKey() of different hosts are both %q", a)
+	}
+}
+
+func TestKeyedEvictsHosts(t *testing.T) {
+	k := newKeyed[int]()
+	host := func(i int) string { return fmt.Sprintf("%s/%d", nodePublishSecretRefKey, i) }
+	k.get("default", func() int { return -1 })
+	for i := 0; i < maxHostKeys; i++ {
+		k.get(host(i), func() int { return i })
+	}
+	// Using the first host again makes the second the least recently used.
+	k.get(host(0), func() int { return 0 })
+	k.get(host(maxHostKeys), func() int { return maxHostKeys })
+
+	got := make(map[string]int)
+	k.each(func(key string, v int) { got[key] = v })
+	if len(got) != maxHostKeys+1 {
+		t.Errorf("keyed holds %d values, want %d", len(got), maxHostKeys+1)
+	}
+	for _, key := range []string{"default", host(0), host(maxHostKeys)} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("keyed evicted %q", key)
+		}
+	}
+	if _, ok := got[host(1)]; ok {
+		t.Errorf("keyed kept %q, the least recently used host", host(1))
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/time/rate"
+)
+
+// errNotSent marks errors of calls that never reached the backend, so they
+// do not count against its circuit breaker.
+var errNotSent = errors.New("backend call not sent")
+
+var queueDuration, _ = meter.Float64Histogram("onepassword.backend.queue.duration",
+	metric.WithUnit("s"),
+	metric.WithDescription("Time backend calls waited for the rate limit of their profile and a free worker, by profile."))
+
+// Limiter bounds the number of concurrent backend calls of all mounts on the
+// node and the rate of calls per key. The server keys rate limits by profile
+// and by the Connect server of mounts naming their own, see backendKey.
+type Limiter struct {
+	// workers holds a token for every call in progress, nil if the number of
+	// calls is not bounded.
+	workers chan struct{}
+	limit   rate.Limit
+	burst   int
+
+	limiters *keyed[*rate.Limiter]
+}
+
+// NewLimiter returns a Limiter allowing up to workers concurrent calls and,
+// per key, perSecond calls per second with bursts of up to burst calls.
+// Zero workers or perSecond disable the respective limit.
+func NewLimiter(workers int, perSecond float64, burst int) *Limiter {
+	l := &Limiter{
+		limit:    rate.Inf,
+		burst:    burst,
+		limiters: newKeyed[*rate.Limiter](),
+	}
+	if workers > 0 {
+		l.workers = make(chan struct{}, workers)
+	}
+	if perSecond > 0 {
+		l.limit = rate.Limit(perSecond)
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	return l
+}
+
+// Backend returns b with its calls queued until they are within the limits
+// and the rate limit of key. Rate limits are kept as described by keyed, so
+// callers must draw keys other than those of Connect servers from a bounded
+// set.
+func (l *Limiter) Backend(b Backend, key string) Backend {
+	return keepScope(b, &limitedBackend{Backend: b, l: l, key: key, rate: l.rateLimiter(key)})
+}
+
+func (l *Limiter) rateLimiter(key string) *rate.Limiter {
+	return l.limiters.get(key, func() *rate.Limiter { return rate.NewLimiter(l.limit, l.burst) })
+}
+
+// limitedBackend queues the calls of a Backend in a Limiter.
+type limitedBackend struct {
+	Backend
+	l    *Limiter
+	key  string
+	rate *rate.Limiter
+}
+
+// do waits for the rate limit and a worker and runs call. The rate limit
+// comes first so that calls of a throttled key do not hold workers other keys
+// could use.
+func (b *limitedBackend) do(ctx context.Context, call func() error) error {
+	start := time.Now()
+	if err := b.rate.Wait(ctx); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %w", errNotSent, ctx.Err())
+		}
+		// The wait would last past the deadline of ctx.
+		return fmt.Errorf("%w: rate limit of %s: %w", errNotSent, b.key, context.DeadlineExceeded)
+	}
+	if b.l.workers != nil {
+		select {
+		case b.l.workers <- struct{}{}:
+			defer func() { <-b.l.workers }()
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", errNotSent, ctx.Err())
+		}
+	}
+	queueDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attribute.String("profile", b.key)))
+	return call()
+}
+
+func (b *limitedBackend) ListVaults(ctx context.Context) (vaults []onepassword.Vault, err error) {
+	err = b.do(ctx, func() error {
+		vaults, err = b.Backend.ListVaults(ctx)
+		return err
+	})
+	return vaults, err
+}
+
+func (b *limitedBackend) FindVaults(ctx context.Context, title string) (vaults []onepassword.Vault, err error) {
+	err = b.do(ctx, func() error {
+		vaults, err = b.Backend.FindVaults(ctx, title)
+		return err
+	})
+	return vaults, err
+}
+
+func (b *limitedBackend) GetItem(ctx context.Context, vaultID, itemID string) (item *onepassword.Item, err error) {
+	err = b.do(ctx, func() error {
+		item, err = b.Backend.GetItem(ctx, vaultID, itemID)
+		return err
+	})
+	return item, err
+}
+
+func (b *limitedBackend) FindItems(ctx context.Context, vaultID, title string) (items []onepassword.Item, err error) {
+	err = b.do(ctx, func() error {
+		items, err = b.Backend.FindItems(ctx, vaultID, title)
+		return err
+	})
+	return items, err
+}
+
+func (b *limitedBackend) ListFiles(ctx context.Context, vaultID, itemID string) (files []onepassword.File, err error) {
+	err = b.do(ctx, func() error {
+		files, err = b.Backend.ListFiles(ctx, vaultID, itemID)
+		return err
+	})
+	return files, err
+}
+
+func (b *limitedBackend) GetFileContent(ctx context.Context, vaultID, itemID string, file *onepassword.File) (data []byte, err error) {
+	err = b.do(ctx, func() error {
+		data, err = b.Backend.GetFileContent(ctx, vaultID, itemID, file)
+		return err
+	})
+	return data, err
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLimiterConcurrency(t *testing.T) {
+	l := NewLimiter(2, 0, 0)
+	b := &testBackend{Backend: newFakeBackend(testItem()), block: make(chan struct{})}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = l.Backend(b, "concurrency").GetItem(context.Background(), testVaultID, testItemID)
+		}(i)
+	}
+	for b.inFlight() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// Give queued calls the chance to exceed the limit.
+	time.Sleep(10 * time.Millisecond)
+	close(b.block)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("GetItem() failed: %v", err)
+		}
+	}
+	if n := b.maxInFlight(); n != 2 {
+		t.Errorf("%d concurrent calls, want 2", n)
+	}
+	if got := metricValue(t, "onepassword.backend.queue.duration", attribute.String("profile", "concurrency")); got != 5 {
+		t.Errorf("queue durations recorded = %d, want 5", got)
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter(0, 0.001, 1)
+	r := NewResilience(1, time.Millisecond, 1, time.Minute)
+	b := r.Backend(l.Backend(&testBackend{Backend: newFakeBackend(testItem())}, "rate"), "rate")
+
+	if _, err := b.GetItem(context.Background(), testVaultID, testItemID); err != nil {
+		t.Fatalf("GetItem() within the burst failed: %v", err)
+	}
+
+	// The next call would have to wait for longer than the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := b.GetItem(ctx, testVaultID, testItemID)
+	if !errors.Is(err, errNotSent) {
+		t.Fatalf("GetItem() over the rate limit got err = %v, want %v", err, errNotSent)
+	}
+	if code := status.Code(statusErr(err, "lookup")); code != codes.DeadlineExceeded {
+		t.Errorf("status code over the rate limit = %v, want %v", code, codes.DeadlineExceeded)
+	}
+	// Calls that were never sent do not open the circuit breaker.
+	if got := r.States()["rate"]; got != "closed" {
+		t.Errorf("circuit breaker state = %q, want closed", got)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// idPattern matches the format of 1Password vault and item IDs.
+var idPattern = regexp.MustCompile("^[a-z0-9]{26}$")
+
+// resolveVault returns the ID of the vault referenced by query.
+func resolveVault(ctx context.Context, client Backend, query, matchBy string) (string, error) {
+	switch matchBy {
+	case config.MatchByID:
+		if !idPattern.MatchString(query) {
+			return "", status.Errorf(codes.InvalidArgument, "vault %q is not a valid vault ID", query)
+		}
+		return query, nil
+	case config.MatchByTitle:
+	default:
+		if idPattern.MatchString(query) {
+			return query, nil
+		}
+	}
+
+	vaults, err := client.FindVaults(ctx, query)
+	if err != nil {
+		return "", statusErr(err, "unable to look up vault %q", query)
+	}
+	ids := make([]string, 0, len(vaults))
+	for _, v := range vaults {
+		if v.Name == query {
+			ids = append(ids, v.ID)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", status.Errorf(codes.NotFound, "vault %q not found", query)
+	case 1:
+		return ids[0], nil
+	default:
+		sort.Strings(ids)
+		return "", status.Errorf(codes.FailedPrecondition, "vault title %q is ambiguous, matches vaults %s", query, strings.Join(ids, ", "))
+	}
+}
+
+// resolveItem fetches the item referenced by query from the vault vaultID.
+func resolveItem(ctx context.Context, client Backend, vaultID, query, matchBy string) (*onepassword.Item, error) {
+	switch matchBy {
+	case config.MatchByID:
+		return getItemByID(ctx, client, vaultID, query)
+	case config.MatchByTitle:
+	default:
+		if idPattern.MatchString(query) {
+			return getItemByID(ctx, client, vaultID, query)
+		}
+	}
+
+	items, err := client.FindItems(ctx, vaultID, query)
+	if err != nil {
+		return nil, statusErr(err, "unable to look up item %q in vault %s", query, vaultID)
+	}
+	matches := make([]*onepassword.Item, 0, len(items))
+	for i := range items {
+		if items[i].Title == query {
+			matches = append(matches, &items[i])
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, status.Errorf(codes.NotFound, "item %q not found in vault %s", query, vaultID)
+	case 1:
+		return matches[0], nil
+	default:
+		ids := make([]string, 0, len(matches))
+		for _, item := range matches {
+			ids = append(ids, item.ID)
+		}
+		sort.Strings(ids)
+		return nil, status.Errorf(codes.FailedPrecondition, "item title %q is ambiguous in vault %s, matches items %s", query, vaultID, strings.Join(ids, ", "))
+	}
+}
+
+// selectField returns the field of item matching the field label or ID,
+// optionally restricted to the section with the given label or ID. It fails
+// if the selector is ambiguous.
+func selectField(item *onepassword.Item, section, field string) (*onepassword.ItemField, error) {
+	var matches []*onepassword.ItemField
+	for _, f := range item.Fields {
+		if section != "" && !inSection(item, f, section) {
+			continue
+		}
+		if f.ID == field {
+			// Field IDs are unique within an item.
+			return f, nil
+		}
+		if f.Label == field {
+			matches = append(matches, f)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		if section != "" {
+			return nil, status.Errorf(codes.NotFound, "field %q in section %q not found in item %s", field, section, item.ID)
+		}
+		return nil, status.Errorf(codes.NotFound, "field %q not found in item %s", field, item.ID)
+	case 1:
+		return matches[0], nil
+	default:
+		sections := make([]string, 0, len(matches))
+		for _, f := range matches {
+			sections = append(sections, fmt.Sprintf("%q", sectionLabel(item, f)))
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "field %q is ambiguous in item %s, found in sections %s; select a section", field, item.ID, strings.Join(sections, ", "))
+	}
+}
+
+// inSection reports whether field belongs to the section with the given label
+// or ID.
+func inSection(item *onepassword.Item, field *onepassword.ItemField, section string) bool {
+	if field.Section == nil {
+		return false
+	}
+	return field.Section.ID == section || item.SectionLabelForID(field.Section.ID) == section
+}
+
+// sectionLabel returns the label of the section of field, falling back to the
+// section ID for unlabeled sections.
+func sectionLabel(item *onepassword.Item, field *onepassword.ItemField) string {
+	if field.Section == nil {
+		return ""
+	}
+	if label := item.SectionLabelForID(field.Section.ID); label != "" {
+		return label
+	}
+	return field.Section.ID
+}
+
+func getItemByID(ctx context.Context, client Backend, vaultID, id string) (*onepassword.Item, error) {
+	if !idPattern.MatchString(id) {
+		return nil, status.Errorf(codes.InvalidArgument, "item %q is not a valid item ID", id)
+	}
+	item, err := client.GetItem(ctx, vaultID, id)
+	if err != nil {
+		return nil, statusErr(err, "unable to get item %s in vault %s", id, vaultID)
+	}
+	return item, nil
+}
+
+// statusErr converts an error returned by the 1Password Connect API or a
+// context error into a grpc status error with a matching code.
+func statusErr(err error, format string, args ...interface{}) error {
+	code := codes.Unknown
+	var opErr *onepassword.Error
+	if errors.As(err, &opErr) {
+		switch {
+		case opErr.StatusCode == http.StatusBadRequest:
+			code = codes.InvalidArgument
+		case opErr.StatusCode == http.StatusUnauthorized:
+			code = codes.Unauthenticated
+		case opErr.StatusCode == http.StatusForbidden:
+			code = codes.PermissionDenied
+		case opErr.StatusCode == http.StatusNotFound:
+			code = codes.NotFound
+		case opErr.StatusCode == http.StatusTooManyRequests:
+			code = codes.ResourceExhausted
+		case opErr.StatusCode >= http.StatusInternalServerError:
+			code = codes.Unavailable
+		}
+	}
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		code = codes.Unavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	}
+	return status.Errorf(code, "%s: %v", fmt.Sprintf(format, args...), err)
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/internal/metrictest"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// testMetrics collects the metrics recorded by the tests of the package.
+var testMetrics = sdkmetric.NewManualReader()
+
+// testPrometheus exposes the metrics recorded by the tests of the package as
+// they are served on /metrics.
+var testPrometheus = prometheus.NewRegistry()
+
+// testSpans records the spans of the tests of the package.
+var testSpans = tracetest.NewSpanRecorder()
+
+func TestMain(m *testing.M) {
+	exporter, err := otelprom.New(otelprom.WithRegisterer(testPrometheus))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "otelprom.New() failed: %v\n", err)
+		os.Exit(1)
+	}
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(testMetrics), sdkmetric.WithReader(exporter)))
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(testSpans)))
+	os.Exit(m.Run())
+}
+
+// metricValue returns the value of the metric name with the given attributes,
+// see metrictest.Value.
+func metricValue(t *testing.T, name string, attrs ...attribute.KeyValue) int64 {
+	t.Helper()
+	return metrictest.Value(t, testMetrics, name, attrs...)
+}
+
+// testBackend wraps a Backend for the tests of the decorators around it. It
+// counts the lookups of every operation and the item lookups in flight, and
+// fails, blocks or edits lookups as set up.
+type testBackend struct {
+	Backend
+	// scope is the scope of the credentials the backend reports.
+	scope string
+	// block makes item lookups wait until it is closed or their context is
+	// done. If blocked is set, only lookups of that item ID wait.
+	block   chan struct{}
+	blocked string
+	// editing makes every item lookup return a new version of the test item,
+	// with a new password and file.
+	editing bool
+
+	mu    sync.Mutex
+	calls map[string]int
+	err   error
+	// failures is the number of lookups left to fail with err, negative
+	// for all of them.
+	failures int
+	current  int
+	max      int
+	deadline time.Time
+	version  int
+}
+
+func (b *testBackend) Scope() string {
+	return b.scope
+}
+
+// failNext fails the next n lookups with err, all of them if n is negative,
+// and resets the counts of calls.
+func (b *testBackend) failNext(n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures, b.err, b.calls = n, err, nil
+}
+
+// fail fails all lookups with err until it is called with nil.
+func (b *testBackend) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures, b.err = -1, err
+}
+
+// count returns the number of lookups of op.
+func (b *testBackend) count(op string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[op]
+}
+
+// inFlight returns the number of item lookups in progress.
+func (b *testBackend) inFlight() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current
+}
+
+// maxInFlight returns the largest number of item lookups in progress at once.
+func (b *testBackend) maxInFlight() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.max
+}
+
+// lastDeadline returns the deadline of the last lookup, zero if it had none.
+func (b *testBackend) lastDeadline() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.deadline
+}
+
+// start records a lookup of op and returns the error it fails with, if any.
+func (b *testBackend) start(ctx context.Context, op string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.calls == nil {
+		b.calls = make(map[string]int)
+	}
+	b.calls[op]++
+	b.deadline, _ = ctx.Deadline()
+	if b.err == nil || b.failures == 0 {
+		return nil
+	}
+	if b.failures > 0 {
+		b.failures--
+	}
+	return b.err
+}
+
+// edit returns a new version of the test item.
+func (b *testBackend) edit() *onepassword.Item {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.version++
+	item := testItem()
+	item.Version = b.version
+	item.Fields[1].Value = fmt.Sprintf("password-%d", b.version)
+	item.Files = []*onepassword.File{testFile("caid", "ca.pem", []byte(fmt.Sprintf("ca-%d", b.version)))}
+	return item
+}
+
+func (b *testBackend) FindVaults(ctx context.Context, title string) ([]onepassword.Vault, error) {
+	if err := b.start(ctx, "find_vaults"); err != nil {
+		return nil, err
+	}
+	return b.Backend.FindVaults(ctx, title)
+}
+
+func (b *testBackend) GetItem(ctx context.Context, vaultID, itemID string) (*onepassword.Item, error) {
+	if err := b.start(ctx, "get_item"); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.current++
+	if b.current > b.max {
+		b.max = b.current
+	}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.current--
+		b.mu.Unlock()
+	}()
+	if b.block != nil && (b.blocked == "" || itemID == b.blocked) {
+		select {
+		case <-b.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if b.editing {
+		return b.edit(), nil
+	}
+	return b.Backend.GetItem(ctx, vaultID, itemID)
+}
+
+func (b *testBackend) FindItems(ctx context.Context, vaultID, title string) ([]onepassword.Item, error) {
+	if err := b.start(ctx, "find_items"); err != nil {
+		return nil, err
+	}
+	if b.editing {
+		return []onepassword.Item{*b.edit()}, nil
+	}
+	return b.Backend.FindItems(ctx, vaultID, title)
+}
+
+func (b *testBackend) ListFiles(ctx context.Context, vaultID, itemID string) ([]onepassword.File, error) {
+	if err := b.start(ctx, "list_files"); err != nil {
+		return nil, err
+	}
+	if b.editing {
+		return []onepassword.File{*b.edit().Files[0]}, nil
+	}
+	return b.Backend.ListFiles(ctx, vaultID, itemID)
+}
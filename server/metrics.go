@@ -0,0 +1,164 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1"
+)
+
+// Metrics are labeled with values from bounded sets only: gRPC codes,
+// namespaces, backend keys, operations and error classes. Pod names and item
+// references are never used as labels, and backend calls are labeled by the
+// backend key of their profile or Connect server rather than URL as a
+// nodePublishSecretRef may name any URL, see backendKey.
+var (
+	mountRequests, _ = meter.Int64Counter("onepassword.mount.requests",
+		metric.WithDescription("Mount requests, by gRPC result code and pod namespace."))
+	mountDuration, _ = meter.Float64Histogram("onepassword.mount.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of mount requests, by gRPC result code."))
+	mountSecrets, _ = meter.Int64Histogram("onepassword.mount.secrets",
+		metric.WithDescription("Secrets per mount request."),
+		metric.WithExplicitBucketBoundaries(1, 2, 5, 10, 20, 50, 100, 200, 500))
+	mountResponseSize, _ = meter.Int64Histogram("onepassword.mount.response.size",
+		metric.WithUnit("By"),
+		metric.WithDescription("Size of the files returned by successful mount requests."),
+		metric.WithExplicitBucketBoundaries(64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304))
+	backendDuration, _ = meter.Float64Histogram("onepassword.backend.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of backend calls, by operation and profile."))
+	backendErrors, _ = meter.Int64Counter("onepassword.backend.errors",
+		metric.WithDescription("Failed backend calls, by operation, profile and class of the error."))
+)
+
+// recordMount records the metrics of a mount request of a pod in namespace.
+func recordMount(ctx context.Context, start time.Time, namespace string, secrets int, resp *v1alpha1.MountResponse, code codes.Code) {
+	mountRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("code", code.String()), attribute.String("namespace", namespace)))
+	mountDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attribute.String("code", code.String())))
+	if secrets > 0 {
+		mountSecrets.Record(ctx, int64(secrets))
+	}
+	if resp != nil {
+		var size int64
+		for _, f := range resp.GetFiles() {
+			size += int64(len(f.GetContents()))
+		}
+		mountResponseSize.Record(ctx, size)
+	}
+}
+
+// errorClass classifies the error of a backend call for metrics.
+func errorClass(err error) string {
+	var opErr *onepassword.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &opErr):
+		switch {
+		case opErr.StatusCode == http.StatusNotFound:
+			return "not_found"
+		case opErr.StatusCode == http.StatusUnauthorized, opErr.StatusCode == http.StatusForbidden:
+			return "auth"
+		case opErr.StatusCode == http.StatusTooManyRequests:
+			return "rate_limited"
+		case opErr.StatusCode >= http.StatusInternalServerError:
+			return "server"
+		}
+	case unavailable(err):
+		return "transport"
+	}
+	return "other"
+}
+
+// instrumentedBackend records the duration and errors of the calls of a
+// Backend of a profile and traces them.
+type instrumentedBackend struct {
+	Backend
+	profile string
+}
+
+// instrument returns b with its calls recorded in the metrics of profile, the
+// backend key of the profile or Connect server b calls.
+func instrument(b Backend, profile string) Backend {
+	return keepScope(b, &instrumentedBackend{Backend: b, profile: profile})
+}
+
+// start starts the span of the call op and returns its context and a
+// function recording the result of the call.
+func (b *instrumentedBackend) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "onepassword."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		append(attrs, attribute.String("onepassword.profile", b.profile))...))
+	return ctx, func(err error) {
+		metricAttrs := []attribute.KeyValue{attribute.String("operation", op), attribute.String("profile", b.profile)}
+		backendDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(metricAttrs...))
+		if err != nil {
+			backendErrors.Add(ctx, 1, metric.WithAttributes(append(metricAttrs, attribute.String("class", errorClass(err)))...))
+		}
+		endSpan(span, err)
+	}
+}
+
+func (b *instrumentedBackend) ListVaults(ctx context.Context) ([]onepassword.Vault, error) {
+	ctx, done := b.start(ctx, "list_vaults")
+	vaults, err := b.Backend.ListVaults(ctx)
+	done(err)
+	return vaults, err
+}
+
+func (b *instrumentedBackend) FindVaults(ctx context.Context, title string) ([]onepassword.Vault, error) {
+	ctx, done := b.start(ctx, "find_vaults", attribute.String("onepassword.vault.title", title))
+	vaults, err := b.Backend.FindVaults(ctx, title)
+	done(err)
+	return vaults, err
+}
+
+func (b *instrumentedBackend) GetItem(ctx context.Context, vaultID, itemID string) (*onepassword.Item, error) {
+	ctx, done := b.start(ctx, "get_item", attribute.String("onepassword.vault.id", vaultID), attribute.String("onepassword.item.id", itemID))
+	item, err := b.Backend.GetItem(ctx, vaultID, itemID)
+	done(err)
+	return item, err
+}
+
+func (b *instrumentedBackend) FindItems(ctx context.Context, vaultID, title string) ([]onepassword.Item, error) {
+	ctx, done := b.start(ctx, "find_items", attribute.String("onepassword.vault.id", vaultID), attribute.String("onepassword.item.title", title))
+	items, err := b.Backend.FindItems(ctx, vaultID, title)
+	done(err)
+	return items, err
+}
+
+func (b *instrumentedBackend) ListFiles(ctx context.Context, vaultID, itemID string) ([]onepassword.File, error) {
+	ctx, done := b.start(ctx, "list_files", attribute.String("onepassword.vault.id", vaultID), attribute.String("onepassword.item.id", itemID))
+	files, err := b.Backend.ListFiles(ctx, vaultID, itemID)
+	done(err)
+	return files, err
+}
+
+func (b *instrumentedBackend) GetFileContent(ctx context.Context, vaultID, itemID string, file *onepassword.File) ([]byte, error) {
+	ctx, done := b.start(ctx, "get_file_content", attribute.String("onepassword.vault.id", vaultID), attribute.String("onepassword.item.id", itemID), attribute.String("onepassword.file.id", file.ID))
+	data, err := b.Backend.GetFileContent(ctx, vaultID, itemID, file)
+	done(err)
+	return data, err
+}
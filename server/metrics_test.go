@@ -0,0 +1,153 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/1Password/connect-sdk-go/connect"
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1"
+)
+
+// prometheusSeries returns the series exposed on /metrics with their values,
+// by name and labels, e.g. `foo_total{code="OK"}`. Histograms are reported
+// by the number of their observations, as `foo_count{...}`. The labels
+// identifying the instrumentation scope are left out.
+func prometheusSeries(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(testPrometheus, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatalf("TextToMetricFamilies() failed: %v\n%s", err, rec.Body)
+	}
+	series := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				if !strings.HasPrefix(l.GetName(), "otel_scope_") {
+					labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+				}
+			}
+			sort.Strings(labels)
+			name := f.GetName()
+			value := m.GetCounter().GetValue() + m.GetGauge().GetValue()
+			if h := m.GetHistogram(); h != nil {
+				name += "_count"
+				value = float64(h.GetSampleCount())
+			}
+			series[fmt.Sprintf("%s{%s}", name, strings.Join(labels, ","))] = value
+		}
+	}
+	return series
+}
+
+func TestMountMetrics(t *testing.T) {
+	s := &Server{
+		Clients: testRegistry(t, map[string]connect.Client{"default": newFakeClient(), "metrics": newFakeClient(testItem())}),
+	}
+	mount := func(resourceName string) error {
+		_, err := s.Mount(context.Background(), &v1alpha1.MountRequest{
+			Attributes: fmt.Sprintf(`{"connect": "metrics", "secrets": "- resourceName: %s\n  path: out\n", "csi.storage.k8s.io/pod.namespace": "metrics", "csi.storage.k8s.io/pod.name": "pod-1234"}`, resourceName),
+			Secrets:    "{}",
+			TargetPath: "/tmp",
+			Permission: "420",
+		})
+		return err
+	}
+	if err := mount("op://Production/Postgres/password"); err != nil {
+		t.Fatalf("Mount() failed: %v", err)
+	}
+	if err := mount("op://Production/zzzzzzzzzzzzzzzzzzzzzzzzzz/password"); err == nil {
+		t.Fatalf("Mount() of a missing item succeeded")
+	}
+
+	series := prometheusSeries(t)
+	for _, want := range []string{
+		`onepassword_mount_requests_total{code="OK",namespace="metrics"}`,
+		`onepassword_mount_requests_total{code="Internal",namespace="metrics"}`,
+		`onepassword_backend_duration_seconds_count{operation="find_items",profile="metrics"}`,
+		`onepassword_backend_duration_seconds_count{operation="get_item",profile="metrics"}`,
+		`onepassword_backend_errors_total{class="not_found",operation="get_item",profile="metrics"}`,
+	} {
+		if series[want] != 1 {
+			t.Errorf("series %s = %v, want 1", want, series[want])
+		}
+	}
+	for _, want := range []string{
+		`onepassword_mount_duration_seconds_count{code="OK"}`,
+		`onepassword_mount_secrets_count{}`,
+		`onepassword_mount_response_size_bytes_count{}`,
+	} {
+		if series[want] == 0 {
+			t.Errorf("series %s not exposed", want)
+		}
+	}
+
+	// Only labels with values from bounded sets are exposed.
+	allowed := map[string]bool{"code": true, "namespace": true, "operation": true, "profile": true, "class": true, "result": true}
+	for name := range series {
+		if !strings.HasPrefix(name, "onepassword_") {
+			continue
+		}
+		labels := name[strings.Index(name, "{")+1 : len(name)-1]
+		for _, l := range strings.Split(labels, ",") {
+			if l == "" {
+				continue
+			}
+			if key := l[:strings.Index(l, "=")]; !allowed[key] {
+				t.Errorf("series %s has label %s with unbounded values", name, key)
+			}
+		}
+		if strings.Contains(name, "pod-1234") || strings.Contains(name, "Postgres") {
+			t.Errorf("series %s exposes a pod or item name", name)
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{&onepassword.Error{StatusCode: 404}, "not_found"},
+		{&onepassword.Error{StatusCode: 401}, "auth"},
+		{fmt.Errorf("get item: %w", &onepassword.Error{StatusCode: 403}), "auth"},
+		{&onepassword.Error{StatusCode: 429}, "rate_limited"},
+		{&onepassword.Error{StatusCode: 503}, "server"},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "transport"},
+		{context.DeadlineExceeded, "transport"},
+		{errCircuitOpen, "transport"},
+		{context.Canceled, "canceled"},
+		{&onepassword.Error{StatusCode: 400}, "other"},
+	} {
+		if got := errorClass(tc.err); got != tc.want {
+			t.Errorf("errorClass(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// maxRetryDelay bounds the delay between two attempts of a backend call.
+const maxRetryDelay = 5 * time.Second
+
+// errCircuitOpen is returned without calling the backend while its circuit
+// breaker is open.
+var errCircuitOpen = errors.New("circuit breaker open, backend is failing")
+
+var (
+	backendRetries, _ = meter.Int64Counter("onepassword.backend.retries",
+		metric.WithDescription("Retried backend calls, by operation."))
+	circuitState, _ = meter.Int64ObservableGauge("onepassword.circuit.state",
+		metric.WithDescription("State of the circuit breaker of each profile: 0 closed, 1 half-open, 2 open."))
+)
+
+// Resilience retries backend calls failing with retryable errors and keeps a
+// circuit breaker per key, so mounts fail fast while a Connect server is down
+// instead of piling up on it. The server keys breakers by profile and by the
+// Connect server of mounts naming their own, see backendKey.
+type Resilience struct {
+	attempts    int
+	baseDelay   time.Duration
+	threshold   int
+	openTimeout time.Duration
+
+	breakers *keyed[*breaker]
+
+	// clock returns the current time, time.Now if nil.
+	clock func() time.Time
+	// sleep waits for d or until ctx is done, sleepContext if nil.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewResilience returns a Resilience making up to attempts attempts per call,
+// waiting about baseDelay before the first retry and doubling the delay for
+// each further retry. The circuit breaker of a key opens after
+// threshold consecutive failures and lets a single call through again after
+// openTimeout. A threshold of zero disables the circuit breakers.
+func NewResilience(attempts int, baseDelay time.Duration, threshold int, openTimeout time.Duration) *Resilience {
+	r := &Resilience{
+		attempts:    attempts,
+		baseDelay:   baseDelay,
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		breakers:    newKeyed[*breaker](),
+	}
+	meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		r.breakers.each(func(key string, b *breaker) {
+			o.ObserveInt64(circuitState, int64(b.current()), metric.WithAttributes(attribute.String("profile", key)))
+		})
+		return nil
+	}, circuitState)
+	return r
+}
+
+func (r *Resilience) now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
+}
+
+// Backend returns b with its calls retried and guarded by the circuit breaker
+// of key. Retries stop when the context of the call is done or its deadline
+// would pass before the next attempt. Breakers are kept as described by
+// keyed, so callers must draw keys other than those of Connect servers from a
+// bounded set.
+func (r *Resilience) Backend(b Backend, key string) Backend {
+	rb := &resilientBackend{Backend: b, r: r, key: key}
+	if r.threshold > 0 {
+		rb.breaker = r.breaker(key)
+	}
+	return keepScope(b, rb)
+}
+
+// States returns the state of the circuit breaker of every key called so far:
+// "closed", "half-open" or "open".
+func (r *Resilience) States() map[string]string {
+	states := make(map[string]string)
+	r.breakers.each(func(key string, b *breaker) {
+		states[key] = b.current().String()
+	})
+	return states
+}
+
+func (r *Resilience) breaker(key string) *breaker {
+	return r.breakers.get(key, func() *breaker { return &breaker{r: r} })
+}
+
+// delay returns the jittered delay before retrying after attempt attempts.
+func (r *Resilience) delay(attempt int) time.Duration {
+	d := r.baseDelay << (attempt - 1)
+	if d > maxRetryDelay || d <= 0 {
+		d = maxRetryDelay
+	}
+	// Wait between half and all of the delay so that mounts failing at the
+	// same time do not retry in lockstep.
+	return d/2 + rand.N(d/2+1)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryable reports whether a call failing with err may succeed if repeated.
+func retryable(err error) bool {
+	if errors.Is(err, errCircuitOpen) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var opErr *onepassword.Error
+	if errors.As(err, &opErr) && opErr.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return unavailable(err)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is the circuit breaker of a key. It opens after a number of
+// consecutive failures of the backends of the key, rejects calls while open
+// and, once the open timeout passed, lets a single probe through to decide
+// whether to close again.
+type breaker struct {
+	r *Resilience
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *breaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow reports whether a call may be made.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.r.now().Sub(b.openedAt) < b.r.openTimeout {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of an allowed call. Only
+// failures of the backend itself count; rejected requests like a missing item
+// show that it is up.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if errors.Is(err, context.Canceled) || errors.Is(err, errNotSent) {
+		// The caller gave up or the call was never sent, which says
+		// nothing about the backend.
+		return
+	}
+	if err == nil || !unavailable(err) {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.r.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.r.now()
+	}
+}
+
+// resilientBackend retries the calls of a Backend and guards them with a
+// circuit breaker.
+type resilientBackend struct {
+	Backend
+	r       *Resilience
+	key     string
+	breaker *breaker
+}
+
+func (b *resilientBackend) do(ctx context.Context, op string, call func() error) error {
+	sleep := b.r.sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+	for attempt := 1; ; attempt++ {
+		if b.breaker != nil && !b.breaker.allow() {
+			return fmt.Errorf("%s: %w", b.key, errCircuitOpen)
+		}
+		err := call()
+		if b.breaker != nil {
+			b.breaker.record(err)
+		}
+		if err == nil || !retryable(err) || attempt >= b.r.attempts {
+			return err
+		}
+		delay := b.r.delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && b.r.now().Add(delay).After(deadline) {
+			return err
+		}
+		if sleep(ctx, delay) != nil {
+			return err
+		}
+		backendRetries.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", op)))
+	}
+}
+
+func (b *resilientBackend) ListVaults(ctx context.Context) (vaults []onepassword.Vault, err error) {
+	err = b.do(ctx, "list_vaults", func() error {
+		vaults, err = b.Backend.ListVaults(ctx)
+		return err
+	})
+	return vaults, err
+}
+
+func (b *resilientBackend) FindVaults(ctx context.Context, title string) (vaults []onepassword.Vault, err error) {
+	err = b.do(ctx, "find_vaults", func() error {
+		vaults, err = b.Backend.FindVaults(ctx, title)
+		return err
+	})
+	return vaults, err
+}
+
+func (b *resilientBackend) GetItem(ctx context.Context, vaultID, itemID string) (item *onepassword.Item, err error) {
+	err = b.do(ctx, "get_item", func() error {
+		item, err = b.Backend.GetItem(ctx, vaultID, itemID)
+		return err
+	})
+	return item, err
+}
+
+func (b *resilientBackend) FindItems(ctx context.Context, vaultID, title string) (items []onepassword.Item, err error) {
+	err = b.do(ctx, "find_items", func() error {
+		items, err = b.Backend.FindItems(ctx, vaultID, title)
+		return err
+	})
+	return items, err
+}
+
+func (b *resilientBackend) ListFiles(ctx context.Context, vaultID, itemID string) (files []onepassword.File, err error) {
+	err = b.do(ctx, "list_files", func() error {
+		files, err = b.Backend.ListFiles(ctx, vaultID, itemID)
+		return err
+	})
+	return files, err
+}
+
+func (b *resilientBackend) GetFileContent(ctx context.Context, vaultID, itemID string, file *onepassword.File) (data []byte, err error) {
+	err = b.do(ctx, "get_file_content", func() error {
+		data, err = b.Backend.GetFileContent(ctx, vaultID, itemID, file)
+		return err
+	})
+	return data, err
+}
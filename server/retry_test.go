@@ -0,0 +1,160 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "server error", err: &onepassword.Error{StatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "rate limited", err: &onepassword.Error{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "timeout", err: context.DeadlineExceeded, want: true},
+		{name: "not found", err: &onepassword.Error{StatusCode: http.StatusNotFound}},
+		{name: "canceled", err: context.Canceled},
+		{name: "circuit open", err: errCircuitOpen},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := retryable(tc.err); got != tc.want {
+				t.Errorf("retryable(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResilienceRetries(t *testing.T) {
+	r := NewResilience(3, 100*time.Millisecond, 0, time.Minute)
+	var delays []time.Duration
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	b := &testBackend{Backend: newFakeBackend(testItem())}
+
+	retries := metricValue(t, "onepassword.backend.retries", attribute.String("operation", "get_item"))
+	b.failNext(2, &onepassword.Error{StatusCode: http.StatusBadGateway})
+	if _, err := r.Backend(b, "retries").GetItem(context.Background(), testVaultID, testItemID); err != nil {
+		t.Fatalf("GetItem() failed: %v", err)
+	}
+	if n := b.count("get_item"); n != 3 {
+		t.Errorf("backend called %d times, want 3", n)
+	}
+	if got := metricValue(t, "onepassword.backend.retries", attribute.String("operation", "get_item")); got != retries+2 {
+		t.Errorf("retries = %d, want %d", got, retries+2)
+	}
+	if len(delays) != 2 || delays[0] < 50*time.Millisecond || delays[0] > 100*time.Millisecond ||
+		delays[1] < 100*time.Millisecond || delays[1] > 200*time.Millisecond {
+		t.Errorf("retried after %v, want jittered exponential delays from 100ms", delays)
+	}
+
+	b.failNext(5, &onepassword.Error{StatusCode: http.StatusBadGateway})
+	if _, err := r.Backend(b, "retries").GetItem(context.Background(), testVaultID, testItemID); err == nil {
+		t.Errorf("GetItem() succeeded after all attempts failed, want error")
+	}
+	if n := b.count("get_item"); n != 3 {
+		t.Errorf("backend called %d times, want 3 attempts", n)
+	}
+
+	b.failNext(1, &onepassword.Error{StatusCode: http.StatusNotFound})
+	if _, err := r.Backend(b, "retries").GetItem(context.Background(), testVaultID, testItemID); err == nil {
+		t.Errorf("GetItem() of a missing item succeeded, want error")
+	}
+	if n := b.count("get_item"); n != 1 {
+		t.Errorf("backend called %d times for a missing item, want 1", n)
+	}
+
+	// Retries that would end after the deadline of the request are skipped.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	b.failNext(1, &onepassword.Error{StatusCode: http.StatusBadGateway})
+	if _, err := r.Backend(b, "retries").GetItem(ctx, testVaultID, testItemID); err == nil {
+		t.Errorf("GetItem() retried past the deadline")
+	}
+	if n := b.count("get_item"); n != 1 {
+		t.Errorf("backend called %d times close to the deadline, want 1", n)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := NewResilience(1, time.Millisecond, 2, time.Minute)
+	r.clock = func() time.Time { return now }
+	b := &testBackend{Backend: newFakeBackend(testItem())}
+	profile := attribute.String("profile", "breaker")
+
+	b.failNext(2, &onepassword.Error{StatusCode: http.StatusInternalServerError})
+	for i := 0; i < 2; i++ {
+		r.Backend(b, "breaker").GetItem(context.Background(), testVaultID, testItemID)
+	}
+	_, err := r.Backend(b, "breaker").GetItem(context.Background(), testVaultID, testItemID)
+	if !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("GetItem() with an open circuit got err = %v, want %v", err, errCircuitOpen)
+	}
+	if n := b.count("get_item"); n != 2 {
+		t.Errorf("backend called %d times, want 2 before the circuit opened", n)
+	}
+	if code := status.Code(statusErr(err, "lookup")); code != codes.Unavailable {
+		t.Errorf("status code of open circuit = %v, want %v", code, codes.Unavailable)
+	}
+	if got := r.States()["breaker"]; got != "open" {
+		t.Errorf("state = %q, want open", got)
+	}
+	if got := metricValue(t, "onepassword.circuit.state", profile); got != int64(breakerOpen) {
+		t.Errorf("circuit state gauge = %d, want %d", got, breakerOpen)
+	}
+
+	// A failing probe after the open timeout opens the circuit again.
+	now = now.Add(time.Minute)
+	b.failNext(1, &onepassword.Error{StatusCode: http.StatusInternalServerError})
+	r.Backend(b, "breaker").GetItem(context.Background(), testVaultID, testItemID)
+	if got := r.States()["breaker"]; got != "open" {
+		t.Errorf("state after failed probe = %q, want open", got)
+	}
+
+	// A successful probe closes it.
+	now = now.Add(time.Minute)
+	if _, err := r.Backend(b, "breaker").GetItem(context.Background(), testVaultID, testItemID); err != nil {
+		t.Fatalf("GetItem() probe failed: %v", err)
+	}
+	if got := r.States()["breaker"]; got != "closed" {
+		t.Errorf("state after successful probe = %q, want closed", got)
+	}
+	if got := metricValue(t, "onepassword.circuit.state", profile); got != int64(breakerClosed) {
+		t.Errorf("circuit state gauge = %d, want %d", got, breakerClosed)
+	}
+}
+
+func TestResilienceKeepsScope(t *testing.T) {
+	r := NewResilience(3, time.Millisecond, 5, time.Minute)
+	b := r.Backend(NewConnectBackend(newFakeClient(testItem())), "scope")
+	if _, ok := b.(scoper); !ok {
+		t.Errorf("Backend() dropped the scope of the backend")
+	}
+}
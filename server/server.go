@@ -17,81 +17,135 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"hash/crc32"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/policy"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/profiles"
 
-	"github.com/1Password/connect-sdk-go/connect"
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	spb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/anypb"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1"
 )
 
-// TODO: implement this better, elsewhere.  copied here so we can move forward quickly.
-
-type SecretPayload struct {
-
-	// The secret data. Must be no larger than 64KiB.
-	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
-	// Optional. If specified,
-	// [SecretManagerService][google.cloud.secretmanager.v1.SecretManagerService]
-	// will verify the integrity of the received
-	// [data][google.cloud.secretmanager.v1.SecretPayload.data] on
-	// [SecretManagerService.AddSecretVersion][google.cloud.secretmanager.v1.SecretManagerService.AddSecretVersion]
-	// calls using the crc32c checksum and store it to include in future
-	// [SecretManagerService.AccessSecretVersion][google.cloud.secretmanager.v1.SecretManagerService.AccessSecretVersion]
-	// responses. If a checksum is not provided in the
-	// [SecretManagerService.AddSecretVersion][google.cloud.secretmanager.v1.SecretManagerService.AddSecretVersion]
-	// request, the
-	// [SecretManagerService][google.cloud.secretmanager.v1.SecretManagerService]
-	// will generate and store one for you.
-	//
-	// The CRC32C value is encoded as a Int64 for compatibility, and can be
-	// safely downconverted to uint32 in languages that support this type.
-	// https://cloud.google.com/apis/design/design_patterns#integer_types
-	DataCrc32C *int64 `protobuf:"varint,2,opt,name=data_crc32c,json=dataCrc32c,proto3,oneof" json:"data_crc32c,omitempty"`
-	// contains filtered or unexported fields
+// secretResult holds the files produced for a single config.Secret and the
+// object version reported for it.
+type secretResult struct {
+	files   []resultFile
+	version string
 }
 
-// TODO: implement this better, elsewhere.  copied here so we can move forward quickly.
-
-type AccessSecretVersionResponse struct {
-
-	// The resource name of the [SecretVersion][google.cloud.secretmanager.v1.SecretVersion] in the format
-	// `projects/*/secrets/*/versions/*`.
-	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	// Secret payload
-	Payload *SecretPayload `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
-	// contains filtered or unexported fields
+// resultFile is a file of a secretResult. The path is relative to the path of
+// the secret, an empty path denotes the secret's path itself.
+type resultFile struct {
+	path string
+	data []byte
 }
 
-func (x *AccessSecretVersionResponse) GetName() string {
-	return x.Name
-}
-
-func (x *AccessSecretVersionResponse) GetPayload() *SecretPayload {
-	return x.Payload
+// singleFile returns the result of a secret that mounts exactly one file.
+func singleFile(data []byte, version string) *secretResult {
+	return &secretResult{
+		files:   []resultFile{{data: data}},
+		version: version,
+	}
 }
 
 type Server struct {
-	RuntimeVersion    string
-	OnePasswordClient connect.Client
+	RuntimeVersion string
+	// Clients holds the Connect and service account clients of the
+	// configured profiles.
+	Clients *profiles.Registry
+	// MaxFileSize is the largest file attachment or rendered template in
+	// bytes that will be mounted. Zero disables the limit.
+	MaxFileSize int64
+
+	// Authorizer optionally restricts the items pods may mount. Nil allows
+	// all mounts.
+	Authorizer *policy.Authorizer
+
+	// Limiter optionally bounds the concurrency of backend calls and their
+	// rate per profile. Nil sends calls right away.
+	Limiter *Limiter
+
+	// Resilience optionally retries failed backend calls and guards each
+	// profile with a circuit breaker. Nil makes a single attempt per call.
+	Resilience *Resilience
+
+	// Cache optionally serves vault and item lookups of all mounts from
+	// memory. Nil disables caching.
+	Cache *Cache
+
+	// Stale optionally serves vault and item lookups from earlier mounts
+	// while the backend is unavailable. Nil fails mounts instead.
+	Stale *StaleStore
+
+	// Audit optionally records every mount in an audit log. Nil disables
+	// auditing.
+	Audit *AuditLog
+
+	// VersionKey keys the HMACs the object versions of fields, files and
+	// rendered templates are derived from. Nil uses a random key, so that
+	// versions change, and the driver rewrites unchanged files, whenever the
+	// provider restarts.
+	VersionKey []byte
+
+	versionOnce sync.Once
+	versionKey  []byte
+
+	// clock returns the current time, time.Now if nil.
+	clock func() time.Time
 }
 
 var _ v1alpha1.CSIDriverProviderServer = &Server{}
 
 // Mount implements provider csi-provider method
-func (s *Server) Mount(ctx context.Context, req *v1alpha1.MountRequest) (*v1alpha1.MountResponse, error) {
+func (s *Server) Mount(ctx context.Context, req *v1alpha1.MountRequest) (resp *v1alpha1.MountResponse, err error) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "Server.Mount")
+	var cfg *config.MountConfig
+	var event *auditEvent
+	if s.Audit != nil {
+		event = newAuditEvent(start, req.GetTargetPath())
+		ctx = withAuditEvent(ctx, event)
+	}
+	defer func() {
+		var namespace string
+		var secrets int
+		if cfg != nil {
+			namespace = cfg.PodInfo.Namespace
+			secrets = len(cfg.Secrets)
+		}
+		recordMount(ctx, start, namespace, secrets, resp, status.Code(err))
+		span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+		endSpan(span, err)
+		if event != nil {
+			if cfg == nil {
+				// The mount was rejected before its attributes were
+				// parsed; name the pod if they allow.
+				if pod, err := config.ParsePodInfo(req.GetAttributes()); err == nil {
+					event.setPod(pod)
+				}
+			}
+			event.finish(err)
+			s.Audit.record(event)
+		}
+	}()
+
 	p, err := strconv.ParseUint(req.GetPermission(), 10, 32)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Unable to parse permissions: %s", req.GetPermission()))
@@ -105,14 +159,128 @@ func (s *Server) Mount(ctx context.Context, req *v1alpha1.MountRequest) (*v1alph
 		Permissions: os.FileMode(p),
 	}
 
-	cfg, err := config.Parse(params)
+	_, parseSpan := tracer.Start(ctx, "config.Parse")
+	cfg, err = config.Parse(params)
+	endSpan(parseSpan, err)
 	if err != nil {
+		cfg = nil
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	event.setConfig(cfg)
+	span.SetAttributes(
+		attribute.String("k8s.namespace.name", cfg.PodInfo.Namespace),
+		attribute.String("k8s.pod.name", cfg.PodInfo.Name),
+		attribute.String("onepassword.profile", cfg.Profile),
+		attribute.Int("onepassword.secrets", len(cfg.Secrets)),
+	)
+
+	if s.Authorizer != nil {
+		if err := s.Authorizer.Authorize(ctx, cfg); err != nil {
+			klog.InfoS("mount denied by access policy", "pod", klog.ObjectRef{Namespace: cfg.PodInfo.Namespace, Name: cfg.PodInfo.Name}, "err", err)
+			event.setOutcome(outcomeDenied)
+			return nil, err
+		}
+	}
+
+	backend, err := s.backendFor(cfg)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	profile := cfg.Profile
+	if profile == "" {
+		profile = s.Clients.Default()
+	}
+	key := backendKey(cfg, profile)
+	backend = instrument(backend, key)
+	if s.Limiter != nil {
+		backend = s.Limiter.Backend(backend, key)
+	}
+	if s.Resilience != nil {
+		backend = s.Resilience.Backend(backend, key)
+	}
+	if s.Cache != nil {
+		backend = s.Cache.Backend(backend)
+	}
+	event.setOutcome(outcomeAllowed)
 
 	// Fetch the secrets from the secretmanager API based on the
 	// SecretProviderClass configuration.
-	return handleMountEvent(ctx, s.OnePasswordClient, nil, cfg)
+	return s.handleMountEvent(ctx, backend, cfg)
+}
+
+// nodePublishSecretRefKey prefixes the backend keys of mounts whose
+// nodePublishSecretRef names their own Connect server. Profile names are
+// lower case, so they cannot collide with one.
+const nodePublishSecretRefKey = "nodePublishSecretRef"
+
+// backendKey returns the key the backend calls of cfg share a circuit breaker
+// and rate limit under. Mounts naming their own Connect server are keyed by a
+// hash of its host, so that one failing or busy server does not hold up the
+// others while the URLs stay out of the health endpoints and metrics. Only the
+// most recently used hosts are kept, see keyed.
+func backendKey(cfg *config.MountConfig, profile string) string {
+	if cfg.ConnectURL == "" {
+		return profile
+	}
+	host := cfg.ConnectURL
+	if u, err := url.Parse(cfg.ConnectURL); err == nil && u.Host != "" {
+		host = strings.ToLower(u.Host)
+	}
+	sum := sha256.Sum256([]byte(host))
+	return fmt.Sprintf("%s/%x", nodePublishSecretRefKey, sum[:6])
+}
+
+// isHostKey reports whether key is the backend key of a Connect server named
+// by a nodePublishSecretRef.
+func isHostKey(key string) bool {
+	return strings.HasPrefix(key, nodePublishSecretRefKey+"/")
+}
+
+// backendFor returns the backend for the profile and credentials selected by
+// cfg.
+func (s *Server) backendFor(cfg *config.MountConfig) (Backend, error) {
+	if cfg.Auth != config.AuthNodePublishSecretRef {
+		return s.ProfileBackend(cfg.Profile)
+	}
+	p, err := s.Clients.Profile(cfg.Profile)
+	if err != nil {
+		return nil, err
+	}
+	if p.IsServiceAccount() {
+		if cfg.ConnectURL != "" {
+			return nil, fmt.Errorf("the url of the nodePublishSecretRef cannot be used with the service account profile %q", cfg.Profile)
+		}
+		return s.Clients.ServiceAccountWithToken(cfg.Profile, cfg.ConnectToken)
+	}
+	client, err := s.Clients.ClientWithToken(cfg.Profile, cfg.ConnectURL, cfg.ConnectToken)
+	if err != nil {
+		return nil, err
+	}
+	return NewConnectBackend(client), nil
+}
+
+// ProfileBackend returns the backend of the profile name using the profile's
+// own credentials, or of the default profile if name is empty.
+func (s *Server) ProfileBackend(name string) (Backend, error) {
+	p, err := s.Clients.Profile(name)
+	if err != nil {
+		return nil, err
+	}
+	if p.IsServiceAccount() {
+		return s.Clients.ServiceAccount(name)
+	}
+	client, err := s.Clients.Client(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewConnectBackend(client), nil
+}
+
+func (s *Server) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
 }
 
 // Version implements provider csi-provider method
@@ -124,78 +292,131 @@ func (s *Server) Version(ctx context.Context, req *v1alpha1.VersionRequest) (*v1
 	}, nil
 }
 
-func addChecksum(data []byte) SecretPayload {
-	secret := SecretPayload{}
-	secret.Data = data
-	var crc = int64(crc32.Checksum(secret.Data, crc32.IEEETable))
-	secret.DataCrc32C = &crc
-	return secret
-}
-
-func data2Response(data []byte) AccessSecretVersionResponse {
-	withChecksum := addChecksum(data)
-	resp := AccessSecretVersionResponse{Name: "fake", Payload: &withChecksum}
-	return resp
-}
+func (s *Server) fetchOnePasswordSecret(ctx context.Context, client Backend, secret *config.Secret) (*secretResult, error) {
+	if secret.Template != "" {
+		return s.renderTemplate(ctx, client, secret)
+	}
+	ref := secret.Reference
 
-func fetchOnePasswordSecret(client connect.Client, secret *config.Secret) (AccessSecretVersionResponse, error) {
-	errorPayload := addChecksum(nil)
-	errorResponse := AccessSecretVersionResponse{Name: "error", Payload: &errorPayload}
-	split := strings.Split(secret.ResourceName, "/")
-	if len(split) >= 4 {
-		item, err := client.GetItem(split[3], split[1])
+	vaultID, err := resolveVault(ctx, client, ref.Vault, secret.MatchBy)
+	if err != nil {
+		return nil, err
+	}
+	item, err := resolveItem(ctx, client, vaultID, ref.Item, secret.MatchBy)
+	if err != nil {
+		return nil, err
+	}
+	if secret.File != "" {
+		content, err := s.fetchFile(ctx, client, vaultID, item, secret.File)
 		if err != nil {
-			return errorResponse, err
+			return nil, err
 		}
-		if len(split) > 4 {
-			// field or file
-			files, err := client.GetFiles(split[3], split[1])
+		return singleFile(content, s.contentVersion(item, content)), nil
+	}
+	if secret.Expand {
+		files, err := expandItem(item, secret)
+		if err != nil {
+			return nil, err
+		}
+		return &secretResult{files: files, version: s.filesVersion(item, files)}, nil
+	}
+	if secret.Format != "" {
+		content, err := formatItem(item, secret)
+		if err != nil {
+			return nil, err
+		}
+		return singleFile(content, s.contentVersion(item, content)), nil
+	}
+	if ref.Field == "" {
+		if item.Category == onepassword.Document {
+			content, err := s.fetchDocument(ctx, client, vaultID, item)
 			if err != nil {
-				for i, file := range files {
-					if file.Name == split[4] {
-						content, err := client.GetFileContent(&files[i])
-						if err != nil {
-							return data2Response([]byte(content)), nil
-						}
-					}
-				}
+				return nil, err
 			}
-			for _, field := range item.Fields {
-				if field.Label == split[4] {
-					return data2Response([]byte(field.Value)), nil
-				}
-			}
-			return errorResponse, fmt.Errorf("fieldname %s in item not found", split[4])
+			return singleFile(content, s.contentVersion(item, content)), nil
 		}
 		itemJSON, err := json.Marshal(item.Fields)
 		if err != nil {
-			return errorResponse, err
+			return nil, err
 		}
-		return data2Response(itemJSON), nil
+		return singleFile(itemJSON, itemVersion(item)), nil
 	}
-	return errorResponse, fmt.Errorf("resourceName %s in SecretProviderClass secrets list must be in format vault/uuid/secret/secretname[/fieldname]", secret.ResourceName)
 
+	value, version, err := s.fetchField(ctx, client, vaultID, item, ref)
+	if err != nil {
+		return nil, err
+	}
+	return singleFile(value, version), nil
 }
 
-func getOnePasswordSecretsList(client connect.Client) {
-	vaults, err := client.GetVaults()
+// fetchField returns the field or, failing that, the file attachment of item
+// selected by ref, and its object version.
+func (s *Server) fetchField(ctx context.Context, client Backend, vaultID string, item *onepassword.Item, ref *config.Reference) ([]byte, string, error) {
+	field, err := selectField(item, ref.Section, ref.Field)
+	if status.Code(err) == codes.NotFound && ref.Section == "" && ref.Attribute == "" {
+		// Like the op CLI, fall back to file attachments with the name of
+		// the requested field.
+		if content, ferr := s.fetchFile(ctx, client, vaultID, item, ref.Field); status.Code(ferr) != codes.NotFound {
+			if ferr != nil {
+				return nil, "", ferr
+			}
+			return content, s.contentVersion(item, content), nil
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if ref.Attribute == config.AttributeOTP {
+		code, step, err := s.totpCode(item, field)
+		if err != nil {
+			return nil, "", err
+		}
+		return []byte(code), s.totpVersion(item, field, step), nil
+	}
+	value, err := fieldAttribute(field, ref.Attribute)
 	if err != nil {
-		klog.ErrorS(err, "unable to list 1p vaults we should have access to")
-		klog.Fatalln("unable to start")
+		return nil, "", err
 	}
-	for _, v := range vaults {
-		klog.InfoS(v.Name)
+	return []byte(value), s.contentVersion(item, []byte(value)), nil
+}
+
+// fieldAttribute returns the property of field requested by the ?attribute=
+// query parameter of a secret reference.
+func fieldAttribute(field *onepassword.ItemField, attribute string) (string, error) {
+	switch attribute {
+	case "", config.AttributeValue:
+		return field.Value, nil
+	case config.AttributeType:
+		return string(field.Type), nil
+	case config.AttributeID:
+		return field.ID, nil
+	case config.AttributeLabel:
+		return field.Label, nil
+	case config.AttributePurpose:
+		return string(field.Purpose), nil
+	default:
+		return "", fmt.Errorf("unknown attribute %q", attribute)
 	}
 }
 
 // handleMountEvent fetches the secrets from the secretmanager API and
 // include them in the MountResponse based on the SecretProviderClass
 // configuration.
-// TODO: removed was secretclient, remove this from the signature later.
-func handleMountEvent(ctx context.Context, client connect.Client, creds credentials.PerRPCCredentials, cfg *config.MountConfig) (*v1alpha1.MountResponse, error) {
-	results := make([]*AccessSecretVersionResponse, len(cfg.Secrets))
+func (s *Server) handleMountEvent(ctx context.Context, client Backend, cfg *config.MountConfig) (resp *v1alpha1.MountResponse, err error) {
+	results := make([]*secretResult, len(cfg.Secrets))
 	errs := make([]error, len(cfg.Secrets))
-	getOnePasswordSecretsList(client)
+	servedStale := make([]bool, len(cfg.Secrets))
+	staleItems := make([][]*onepassword.Item, len(cfg.Secrets))
+
+	// Secrets referencing the same item share a single lookup and see the
+	// same version of it.
+	snapshot := newSnapshot(client)
+	client = keepScope(client, snapshot)
+
+	// A single failure fails the mount, so the remaining fetches are
+	// aborted as soon as one fails.
+	fetchCtx, abort := context.WithCancel(ctx)
+	defer abort()
 
 	// In parallel fetch all secrets needed for the mount
 	wg := sync.WaitGroup{}
@@ -205,12 +426,52 @@ func handleMountEvent(ctx context.Context, client connect.Client, creds credenti
 		i, secret := i, secret
 		go func() {
 			defer wg.Done()
-			resp, err := fetchOnePasswordSecret(client, secret)
-			results[i] = &resp
-			errs[i] = err
+			fetchCtx, span := tracer.Start(fetchCtx, "fetch secret", trace.WithAttributes(
+				attribute.String("onepassword.secret.path", secret.PathString()),
+				attribute.String("onepassword.secret.resource_name", secret.ResourceName),
+			))
+			defer func() { endSpan(span, errs[i]) }()
+			backend := client
+			var stale *staleBackend
+			if s.Stale != nil {
+				stale = s.Stale.backend(client)
+			}
+			if stale != nil {
+				backend = stale
+			}
+			results[i], errs[i] = s.fetchOnePasswordSecret(fetchCtx, backend, secret)
+			if errs[i] != nil {
+				abort()
+			}
+			// Mark secrets built from stale data so the rotation that
+			// follows the recovery of the backend is visible.
+			if errs[i] == nil && stale != nil && stale.served.Load() {
+				results[i].version += staleVersionSuffix
+				servedStale[i] = true
+			}
+			if stale != nil {
+				staleItems[i] = stale.items
+			}
 		}()
 	}
 	wg.Wait()
+	if event := auditEventFrom(ctx); event != nil {
+		var items []*onepassword.Item
+		for _, s := range staleItems {
+			items = append(items, s...)
+		}
+		event.fetched(errs, servedStale, snapshot.seen(), items)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, statusErr(err, "mount aborted")
+	}
+	// Only report the failures that aborted the other fetches.
+	for i := range errs {
+		if status.Code(errs[i]) == codes.Canceled {
+			errs[i] = nil
+		}
+	}
 
 	// If any access failed, return a grpc status error that includes each
 	// individual status error in the Details field.
@@ -236,16 +497,18 @@ func handleMountEvent(ctx context.Context, client connect.Client, creds credenti
 		}
 
 		result := results[i]
-		out.Files = append(out.Files, &v1alpha1.File{
-			Path:     secret.PathString(),
-			Mode:     mode,
-			Contents: result.Payload.Data,
-		})
-		klog.V(5).InfoS("added secret to response", "resource_name", secret.ResourceName, "file_name", secret.FileName, "pod", klog.ObjectRef{Namespace: cfg.PodInfo.Namespace, Name: cfg.PodInfo.Name})
+		for _, f := range result.files {
+			out.Files = append(out.Files, &v1alpha1.File{
+				Path:     path.Join(secret.PathString(), f.path),
+				Mode:     mode,
+				Contents: f.data,
+			})
+		}
+		klog.V(5).InfoS("added secret to response", "resource_name", secret.ResourceName, "file_name", secret.FileName, "files", len(result.files), "pod", klog.ObjectRef{Namespace: cfg.PodInfo.Namespace, Name: cfg.PodInfo.Name})
 
 		ovs[i] = &v1alpha1.ObjectVersion{
-			Id:      secret.ResourceName,
-			Version: result.GetName(),
+			Id:      secret.PathString(),
+			Version: result.version,
 		}
 	}
 	out.ObjectVersion = ovs
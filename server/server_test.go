@@ -12,43 +12,70 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// TODO: ALL tests are basically broken at present
 package server
 
-/*
-
 import (
 	"context"
-	"net"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/1Password/connect-sdk-go/connect"
+	"github.com/1Password/connect-sdk-go/onepassword"
 	"github.com/google/go-cmp/cmp"
 	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
-	"google.golang.org/api/option"
-	"google.golang.org/grpc"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/policy"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/profiles"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
-	"google.golang.org/grpc/test/bufconn"
 	"google.golang.org/protobuf/testing/protocmp"
 	"sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1"
 )
 
+const (
+	testVaultID = "i7qrtqvqyko35dcv6dgr4savaa"
+	testItemID  = "oi5yyo2xzgn6mh65gl3keu7a7u"
+)
+
+func testItem() *onepassword.Item {
+	return &onepassword.Item{
+		ID:       testItemID,
+		Title:    "Postgres",
+		Vault:    onepassword.ItemVault{ID: testVaultID},
+		Category: onepassword.Database,
+		Sections: []*onepassword.ItemSection{
+			{ID: "primary-id", Label: "primary"},
+			{ID: "replica-id", Label: "replica"},
+		},
+		Fields: []*onepassword.ItemField{
+			{ID: "username", Type: onepassword.FieldTypeString, Purpose: onepassword.FieldPurposeUsername, Label: "username", Value: "admin"},
+			{ID: "password", Type: onepassword.FieldTypeConcealed, Purpose: onepassword.FieldPurposePassword, Label: "password", Value: "hunter2"},
+			{ID: "primary-host", Section: &onepassword.ItemSection{ID: "primary-id"}, Type: onepassword.FieldTypeString, Label: "host", Value: "db-0.internal"},
+			{ID: "replica-host", Section: &onepassword.ItemSection{ID: "replica-id"}, Type: onepassword.FieldTypeString, Label: "host", Value: "db-1.internal"},
+			{ID: "otp", Type: onepassword.FieldTypeOTP, Label: "one-time password", Value: "otpauth://totp/test?secret=GEZDGNBVGY3TQOJQ"},
+		},
+	}
+}
+
 func TestHandleMountEvent(t *testing.T) {
 	secretFileMode := int32(0600) // decimal 384
 
 	cfg := &config.MountConfig{
 		Secrets: []*config.Secret{
-			{
-				ResourceName: "projects/project/secrets/test/versions/latest",
-				FileName:     "good1.txt",
-			},
-			{
-				ResourceName: "projects/project/secrets/test/versions/latest",
-				FileName:     "good2.txt",
-				Mode:         &secretFileMode,
-			},
+			secret(t, "op://Production/Postgres/password", "good1.txt"),
+			secret(t, "vaults/"+testVaultID+"/secrets/"+testItemID+"/username", "good2.txt"),
+			secret(t, "op://Production/Postgres/replica/host", "good3.txt"),
+			secret(t, "op://Production/Postgres/one-time password?attribute=otp", "good4.txt"),
 		},
 		Permissions: 777,
 		PodInfo: &config.PodInfo{
@@ -56,94 +83,108 @@ func TestHandleMountEvent(t *testing.T) {
 			Name:      "test-pod",
 		},
 	}
+	cfg.Secrets[1].Mode = &secretFileMode
 
+	item := testItem()
+	srv := &Server{clock: func() time.Time { return time.Unix(1700000000, 0) }}
 	want := &v1alpha1.MountResponse{
 		ObjectVersion: []*v1alpha1.ObjectVersion{
-			{
-				Id:      "projects/project/secrets/test/versions/latest",
-				Version: "projects/project/secrets/test/versions/2",
-			},
-			{
-				Id:      "projects/project/secrets/test/versions/latest",
-				Version: "projects/project/secrets/test/versions/2",
-			},
+			{Id: "good1.txt", Version: srv.contentVersion(item, []byte("hunter2"))},
+			{Id: "good2.txt", Version: srv.contentVersion(item, []byte("admin"))},
+			{Id: "good3.txt", Version: srv.contentVersion(item, []byte("db-1.internal"))},
+			{Id: "good4.txt", Version: srv.totpVersion(item, item.Fields[4], 56666666)},
 		},
 		Files: []*v1alpha1.File{
-			{
-				Path:     "good1.txt",
-				Mode:     777,
-				Contents: []byte("My Secret"),
-			},
-			{
-				Path:     "good2.txt",
-				Mode:     384, // octal 0600
-				Contents: []byte("My Secret"),
-			},
+			{Path: "good1.txt", Mode: 777, Contents: []byte("hunter2")},
+			{Path: "good2.txt", Mode: 384, Contents: []byte("admin")},
+			{Path: "good3.txt", Mode: 777, Contents: []byte("db-1.internal")},
+			{Path: "good4.txt", Mode: 777, Contents: []byte("017492")},
 		},
 	}
 
-	client := mock(t, &mockSecretServer{
-		accessFn: func(ctx context.Context, _ *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
-			return &secretmanagerpb.AccessSecretVersionResponse{
-				Name: "projects/project/secrets/test/versions/2",
-				Payload: &secretmanagerpb.SecretPayload{
-					Data: []byte("My Secret"),
-				},
-			}, nil
-		},
-	})
-
-	got, err := handleMountEvent(context.Background(), client, NewFakeCreds(), cfg)
+	client := newFakeBackend(item)
+	got, err := srv.handleMountEvent(context.Background(), client, cfg)
 	if err != nil {
-		t.Errorf("handleMountEvent() got err = %v, want err = nil", err)
+		t.Fatalf("handleMountEvent() got err = %v, want err = nil", err)
 	}
 	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
 		t.Errorf("handleMountEvent() returned unexpected response (-want +got):\n%s", diff)
 	}
 }
 
-func TestHandleMountEventSMError(t *testing.T) {
+func TestHandleMountEventVersions(t *testing.T) {
 	cfg := &config.MountConfig{
 		Secrets: []*config.Secret{
-			{
-				ResourceName: "projects/project/secrets/test/versions/latest",
-				FileName:     "good1.txt",
-			},
+			secret(t, "op://Production/Postgres", "item.json"),
+			secret(t, "op://Production/Postgres/username", "username"),
+			secret(t, "op://Production/Postgres/password", "password"),
 		},
 		Permissions: 777,
-		PodInfo: &config.PodInfo{
-			Namespace: "default",
-			Name:      "test-pod",
-		},
+		PodInfo:     &config.PodInfo{Namespace: "default", Name: "test-pod"},
+	}
+	s := &Server{}
+	versions := func(item *onepassword.Item) []string {
+		t.Helper()
+		resp, err := s.handleMountEvent(context.Background(), newFakeBackend(item), cfg)
+		if err != nil {
+			t.Fatalf("handleMountEvent() failed: %v", err)
+		}
+		var out []string
+		for _, ov := range resp.GetObjectVersion() {
+			out = append(out, ov.GetVersion())
+		}
+		return out
 	}
 
-	client := mock(t, &mockSecretServer{
-		accessFn: func(ctx context.Context, _ *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
-			return nil, status.Error(codes.FailedPrecondition, "Secret is Disabled")
-		},
-	})
+	item := testItem()
+	item.Version = 3
+	item.UpdatedAt = time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC)
+	before := versions(item)
+	if again := versions(item); !cmp.Equal(before, again) {
+		t.Fatalf("versions changed without an edit: %v != %v", before, again)
+	}
 
-	_, got := handleMountEvent(context.Background(), client, NewFakeCreds(), cfg)
-	if !strings.Contains(got.Error(), "FailedPrecondition") {
-		t.Errorf("handleMountEvent() got err = %v, want err = nil", got)
+	item.Version = 4
+	item.UpdatedAt = item.UpdatedAt.Add(time.Minute)
+	item.Fields[1].Value = "correct horse battery staple"
+	after := versions(item)
+
+	if before[0] == after[0] {
+		t.Errorf("item version did not change after an edit: %s", after[0])
+	}
+	if before[1] != after[1] {
+		t.Errorf("username version changed although the username did not: %s != %s", before[1], after[1])
+	}
+	if before[2] == after[2] {
+		t.Errorf("password version did not change after the password changed: %s", after[2])
+	}
+}
+
+func TestObjectVersionsKeyed(t *testing.T) {
+	item := testItem()
+	a := &Server{VersionKey: []byte("key a")}
+	b := &Server{VersionKey: []byte("key b")}
+	if a.contentVersion(item, []byte("1234")) != (&Server{VersionKey: []byte("key a")}).contentVersion(item, []byte("1234")) {
+		t.Errorf("contentVersion() differs between servers with the same key")
+	}
+	if a.contentVersion(item, []byte("1234")) == b.contentVersion(item, []byte("1234")) {
+		t.Errorf("contentVersion() is the same with different keys")
+	}
+	if a.renderedVersion([]byte("1234")) == b.renderedVersion([]byte("1234")) {
+		t.Errorf("renderedVersion() is the same with different keys")
+	}
+	// Without a key every server picks its own.
+	if (&Server{}).renderedVersion([]byte("1234")) == (&Server{}).renderedVersion([]byte("1234")) {
+		t.Errorf("renderedVersion() of servers without a key is the same")
 	}
 }
 
-func TestHandleMountEventSMMultipleErrors(t *testing.T) {
+func TestHandleMountEventErrors(t *testing.T) {
 	cfg := &config.MountConfig{
 		Secrets: []*config.Secret{
-			{
-				ResourceName: "projects/project/secrets/test-a/versions/1",
-				FileName:     "good1.txt",
-			},
-			{
-				ResourceName: "projects/project/secrets/test-a/versions/2",
-				FileName:     "bad1.txt",
-			},
-			{
-				ResourceName: "projects/project/secrets/test-b/versions/latest",
-				FileName:     "bad2.txt",
-			},
+			secret(t, "op://Production/Postgres/password", "good1.txt"),
+			secret(t, "op://Production/Postgres/missing", "bad1.txt"),
+			secret(t, "op://Production/Missing/password", "bad2.txt"),
 		},
 		Permissions: 777,
 		PodInfo: &config.PodInfo{
@@ -152,108 +193,480 @@ func TestHandleMountEventSMMultipleErrors(t *testing.T) {
 		},
 	}
 
-	client := mock(t, &mockSecretServer{
-		accessFn: func(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
-			switch req.Name {
-			case "projects/project/secrets/test-a/versions/1":
-				return &secretmanagerpb.AccessSecretVersionResponse{
-					Name: "projects/project/secrets/test-a/versions/1",
-					Payload: &secretmanagerpb.SecretPayload{
-						Data: []byte("good data"),
-					},
-				}, nil
-			case "projects/project/secrets/test-a/versions/2":
-				return nil, status.Error(codes.FailedPrecondition, "Secret is Disabled")
-			case "projects/project/secrets/test-b/versions/latest":
-				return nil, status.Error(codes.PermissionDenied, "User does not have permission on secret")
-			default:
-				return nil, status.Error(codes.FailedPrecondition, "Secret is Disabled")
-			}
+	client := newFakeBackend(testItem())
+	_, got := (&Server{}).handleMountEvent(context.Background(), client, cfg)
+	if got == nil {
+		t.Fatalf("handleMountEvent() got err = nil, want error")
+	}
+	// The first failure aborts the other fetches, so either error may be
+	// reported, but never the aborted fetches.
+	if !strings.Contains(strings.ToLower(got.Error()), "missing") {
+		t.Errorf("handleMountEvent() got err = %v, want missing field or item error", got)
+	}
+	for _, d := range status.Convert(got).Details() {
+		if st, ok := d.(*spb.Status); ok && codes.Code(st.GetCode()) == codes.Canceled {
+			t.Errorf("handleMountEvent() reported aborted fetch: %v", st.GetMessage())
+		}
+	}
+}
+
+func TestHandleMountEventContext(t *testing.T) {
+	blocked := "zzzzzzzzzzzzzzzzzzzzzzzzzz"
+	client := &testBackend{Backend: newFakeBackend(testItem()), block: make(chan struct{}), blocked: blocked}
+	cfg := &config.MountConfig{
+		Secrets: []*config.Secret{
+			secret(t, "op://"+testVaultID+"/"+blocked+"/password", "hung.txt"),
+			secret(t, "op://"+testVaultID+"/"+testItemID+"/missing", "bad.txt"),
 		},
-	})
+		Permissions: 777,
+		PodInfo:     &config.PodInfo{Namespace: "default", Name: "test-pod"},
+	}
 
-	_, got := handleMountEvent(context.Background(), client, NewFakeCreds(), cfg)
-	if !strings.Contains(got.Error(), "FailedPrecondition") {
-		t.Errorf("handleMountEvent() got err = %v, want err = nil", got)
+	// A failing secret aborts the fetches of the others.
+	_, err := (&Server{}).handleMountEvent(context.Background(), client, cfg)
+	if code := status.Code(err); code != codes.Internal || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("handleMountEvent() got err = %v, want missing field error", err)
 	}
-	if !strings.Contains(got.Error(), "PermissionDenied") {
-		t.Errorf("handleMountEvent() got err = %v, want err = nil", got)
+
+	// The deadline of the request ends hung fetches.
+	cfg.Secrets = cfg.Secrets[:1]
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = (&Server{}).handleMountEvent(ctx, client, cfg)
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Errorf("handleMountEvent() after the deadline got code %v, want %v (err = %v)", code, codes.DeadlineExceeded, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = (&Server{}).handleMountEvent(ctx, client, cfg)
+	if code := status.Code(err); code != codes.Canceled {
+		t.Errorf("handleMountEvent() after cancellation got code %v, want %v (err = %v)", code, codes.Canceled, err)
 	}
 }
 
-// mock builds a secretmanager.Client talking to a real in-memory secretmanager
-// GRPC server of the *mockSecretServer.
-func mock(t testing.TB, m *mockSecretServer) *secretmanager.Client {
-	t.Helper()
-	l := bufconn.Listen(1024 * 1024)
-	s := grpc.NewServer()
-	secretmanagerpb.RegisterSecretManagerServiceServer(s, m)
+func TestMountAccessPolicy(t *testing.T) {
+	p, err := policy.Parse([]byte(`rules: [{namespaces: [payments], vaults: [Production], items: [Postgres]}]`))
+	if err != nil {
+		t.Fatalf("policy.Parse() failed: %v", err)
+	}
+	s := &Server{
+		Clients:    testRegistry(t, map[string]connect.Client{"default": newFakeClient(testItem())}),
+		Authorizer: policy.NewAuthorizer(p, nil, "default"),
+	}
+	mount := func(namespace, resourceName string) error {
+		_, err := s.Mount(context.Background(), &v1alpha1.MountRequest{
+			Attributes: fmt.Sprintf(`{"secrets": "- resourceName: %s\n  path: out\n", "csi.storage.k8s.io/pod.namespace": %q, "csi.storage.k8s.io/pod.name": "pod"}`, resourceName, namespace),
+			Secrets:    "{}",
+			TargetPath: "/tmp",
+			Permission: "420",
+		})
+		return err
+	}
 
-	go func() {
-		if err := s.Serve(l); err != nil {
-			t.Errorf("server error: %v", err)
-		}
-	}()
+	if err := mount("payments", "op://Production/Postgres/password"); err != nil {
+		t.Errorf("Mount() of an allowed item got err = %v, want nil", err)
+	}
+	if err := mount("default", "op://Production/Postgres/password"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Mount() from another namespace got err = %v, want PermissionDenied", err)
+	}
+	if err := mount("payments", "op://Production/Redis/password"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Mount() of another item got err = %v, want PermissionDenied", err)
+	}
+}
+
+func TestMountNodePublishSecretRef(t *testing.T) {
+	defaultStub := newConnectStub(t, newFakeClient(testItem()))
+	teamStub := newConnectStub(t, newFakeClient(testItem()))
+	clients := profiles.NewRegistry("default", "test")
+	if err := clients.Register("default", &profiles.Profile{URL: defaultStub.URL}, newFakeClient()); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Clients:    clients,
+		Limiter:    NewLimiter(2, 100, 10),
+		Resilience: NewResilience(1, time.Millisecond, 5, time.Minute),
+	}
+	mount := func(kubeSecrets string) error {
+		_, err := s.Mount(context.Background(), &v1alpha1.MountRequest{
+			Attributes: `{"secrets": "- resourceName: op://Production/Postgres/password\n  path: out\n", "csi.storage.k8s.io/pod.namespace": "default", "csi.storage.k8s.io/pod.name": "pod"}`,
+			Secrets:    kubeSecrets,
+			TargetPath: "/tmp",
+			Permission: "420",
+		})
+		return err
+	}
 
-	conn, err := grpc.Dial(l.Addr().String(), grpc.WithContextDialer(
-		func(context.Context, string) (net.Conn, error) {
-			return l.Dial()
+	if err := mount(`{"token": "team-token"}`); err != nil {
+		t.Fatalf("Mount() failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"Bearer team-token"}, defaultStub.tokens()); diff != "" {
+		t.Errorf("Mount() sent unexpected tokens to the profile's server (-want +got):\n%s", diff)
+	}
+
+	if err := mount(fmt.Sprintf(`{"token": "team-token", "url": %q}`, teamStub.URL)); err != nil {
+		t.Fatalf("Mount() failed: %v", err)
+	}
+	if len(teamStub.tokens()) == 0 {
+		t.Errorf("Mount() did not use the URL of the nodePublishSecretRef")
+	}
+
+	// Circuit breakers and rate limits are kept per profile and per Connect
+	// server of nodePublishSecretRefs, whose URLs are never shown.
+	teamKey := backendKey(&config.MountConfig{ConnectURL: teamStub.URL}, "default")
+	if strings.Contains(teamKey, strings.TrimPrefix(teamStub.URL, "http://")) {
+		t.Errorf("backend key %q contains the host of the Connect server", teamKey)
+	}
+	want := map[string]string{"default": "closed", teamKey: "closed"}
+	if diff := cmp.Diff(want, s.Resilience.States()); diff != "" {
+		t.Errorf("circuit breakers after Mount() differ (-want +got):\n%s", diff)
+	}
+	var limits []string
+	s.Limiter.limiters.each(func(key string, _ *rate.Limiter) { limits = append(limits, key) })
+	sort.Strings(limits)
+	if diff := cmp.Diff([]string{"default", teamKey}, limits); diff != "" {
+		t.Errorf("rate limits after Mount() differ (-want +got):\n%s", diff)
+	}
+	if metricValue(t, "onepassword.backend.duration", attribute.String("operation", "find_vaults"), attribute.String("profile", teamKey)) == 0 {
+		t.Errorf("backend calls of the nodePublishSecretRef were not labeled with %q", teamKey)
+	}
+}
+
+func TestMountProfiles(t *testing.T) {
+	s := &Server{
+		Clients: testRegistry(t, map[string]connect.Client{
+			"default": newFakeClient(),
+			"finance": newFakeClient(testItem()),
 		}),
-		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	mount := func(profile string) error {
+		_, err := s.Mount(context.Background(), &v1alpha1.MountRequest{
+			Attributes: fmt.Sprintf(`{"connect": %q, "secrets": "- resourceName: op://Production/Postgres/password\n  path: out\n", "csi.storage.k8s.io/pod.namespace": "default", "csi.storage.k8s.io/pod.name": "pod"}`, profile),
+			Secrets:    "{}",
+			TargetPath: "/tmp",
+			Permission: "420",
+		})
+		return err
+	}
+
+	if err := mount("finance"); err != nil {
+		t.Errorf("Mount() with the finance profile got err = %v, want nil", err)
+	}
+	if err := mount(""); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Mount() with the default profile got err = %v, want item not found", err)
+	}
+	if err := mount("missing"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Mount() with an unknown profile got err = %v, want InvalidArgument", err)
+	}
+}
+
+func TestBackendFor(t *testing.T) {
+	t.Setenv("TEST_OP_TOKEN", "profile-token")
+	cfg, err := profiles.Parse([]byte(`
+default: main
+profiles:
+  main: {url: 'http://connect.invalid', tokenEnv: TEST_OP_TOKEN}
+  cloud: {type: serviceAccount, tokenEnv: TEST_OP_TOKEN}
+`))
 	if err != nil {
-		t.Fatalf("failed to dial: %v", err)
+		t.Fatalf("profiles.Parse() failed: %v", err)
+	}
+	clients, err := profiles.Load(cfg, "test")
+	if err != nil {
+		t.Fatalf("profiles.Load() failed: %v", err)
+	}
+	s := &Server{Clients: clients}
+
+	tests := []struct {
+		name    string
+		cfg     *config.MountConfig
+		wantSA  bool
+		wantErr bool
+	}{
+		{name: "connect", cfg: &config.MountConfig{}},
+		{name: "service account", cfg: &config.MountConfig{Profile: "cloud"}, wantSA: true},
+		{name: "connect with secret", cfg: &config.MountConfig{Auth: config.AuthNodePublishSecretRef, ConnectToken: "team-token"}},
+		{name: "service account with secret", cfg: &config.MountConfig{Profile: "cloud", Auth: config.AuthNodePublishSecretRef, ConnectToken: "team-token"}, wantSA: true},
+		{name: "service account with url", cfg: &config.MountConfig{Profile: "cloud", Auth: config.AuthNodePublishSecretRef, ConnectToken: "team-token", ConnectURL: "http://connect.invalid"}, wantErr: true},
+		{name: "unknown profile", cfg: &config.MountConfig{Profile: "missing"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.backendFor(tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("backendFor() got err = %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if _, isSA := got.(*profiles.ServiceAccountClient); isSA != tc.wantSA {
+				t.Errorf("backendFor() = %T, want service account %v", got, tc.wantSA)
+			}
+		})
+	}
+}
+
+func TestResolveItem(t *testing.T) {
+	duplicate := testItem()
+	duplicate.ID = "zzzzzzzzzzzzzzzzzzzzzzzzzz"
+	titledLikeID := testItem()
+	titledLikeID.ID = "yyyyyyyyyyyyyyyyyyyyyyyyyy"
+	titledLikeID.Title = "xxxxxxxxxxxxxxxxxxxxxxxxxx"
+	fake := newFakeClient(testItem(), titledLikeID)
+	fake.vaults = append(fake.vaults, onepassword.Vault{ID: "aaaaaaaaaaaaaaaaaaaaaaaaaa", Name: "Shared"}, onepassword.Vault{ID: "bbbbbbbbbbbbbbbbbbbbbbbbbb", Name: "Shared"})
+	client := NewConnectBackend(fake)
+
+	tests := []struct {
+		name     string
+		vault    string
+		item     string
+		matchBy  string
+		wantID   string
+		wantCode codes.Code
+	}{
+		{name: "ids", vault: testVaultID, item: testItemID, wantID: testItemID},
+		{name: "titles", vault: "Production", item: "Postgres", wantID: testItemID},
+		{name: "match by id", vault: testVaultID, item: testItemID, matchBy: config.MatchByID, wantID: testItemID},
+		{name: "match by title", vault: "Production", item: "xxxxxxxxxxxxxxxxxxxxxxxxxx", matchBy: config.MatchByTitle, wantID: "yyyyyyyyyyyyyyyyyyyyyyyyyy"},
+		{name: "id-like title without match by", vault: "Production", item: "xxxxxxxxxxxxxxxxxxxxxxxxxx", wantCode: codes.NotFound},
+		{name: "title with match by id", vault: testVaultID, item: "Postgres", matchBy: config.MatchByID, wantCode: codes.InvalidArgument},
+		{name: "vault title with match by id", vault: "Production", item: testItemID, matchBy: config.MatchByID, wantCode: codes.InvalidArgument},
+		{name: "missing vault", vault: "Staging", item: "Postgres", wantCode: codes.NotFound},
+		{name: "missing item", vault: "Production", item: "MySQL", wantCode: codes.NotFound},
+		{name: "ambiguous vault", vault: "Shared", item: "Postgres", wantCode: codes.FailedPrecondition},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			vaultID, err := resolveVault(context.Background(), client, tc.vault, tc.matchBy)
+			var item *onepassword.Item
+			if err == nil {
+				item, err = resolveItem(context.Background(), client, vaultID, tc.item, tc.matchBy)
+			}
+			if got := status.Code(err); got != tc.wantCode {
+				t.Fatalf("resolve() got code %v, want %v (err = %v)", got, tc.wantCode, err)
+			}
+			if err == nil && item.ID != tc.wantID {
+				t.Errorf("resolve() got item %s, want %s", item.ID, tc.wantID)
+			}
+		})
 	}
 
-	client, err := secretmanager.NewClient(context.Background(), option.WithoutAuthentication(), option.WithGRPCConn(conn))
-	shutdown := func() {
-		t.Log("shutdown called")
-		conn.Close()
-		s.GracefulStop()
-		l.Close()
+	fake.items = append(fake.items, duplicate)
+	_, err := resolveItem(context.Background(), client, testVaultID, "Postgres", "")
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("resolveItem() got err = %v, want FailedPrecondition", err)
 	}
+	if !strings.Contains(err.Error(), testItemID+", "+duplicate.ID) {
+		t.Errorf("resolveItem() got err = %v, want sorted list of matching items", err)
+	}
+}
+
+func TestSelectField(t *testing.T) {
+	tests := []struct {
+		name      string
+		section   string
+		field     string
+		wantValue string
+		wantCode  codes.Code
+	}{
+		{name: "label", field: "password", wantValue: "hunter2"},
+		{name: "id", field: "replica-host", wantValue: "db-1.internal"},
+		{name: "section label", section: "primary", field: "host", wantValue: "db-0.internal"},
+		{name: "section id", section: "replica-id", field: "host", wantValue: "db-1.internal"},
+		{name: "ambiguous label", field: "host", wantCode: codes.FailedPrecondition},
+		{name: "field outside section", section: "primary", field: "password", wantCode: codes.NotFound},
+		{name: "missing field", field: "port", wantCode: codes.NotFound},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := selectField(testItem(), tc.section, tc.field)
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("selectField() got code %v, want %v (err = %v)", code, tc.wantCode, err)
+			}
+			if err == nil && got.Value != tc.wantValue {
+				t.Errorf("selectField() got value %q, want %q", got.Value, tc.wantValue)
+			}
+		})
+	}
+}
+
+func secret(t testing.TB, resourceName, fileName string) *config.Secret {
+	t.Helper()
+	ref, err := config.ParseReference(resourceName)
 	if err != nil {
-		shutdown()
-		t.Fatal(err)
+		t.Fatalf("ParseReference(%q) failed: %v", resourceName, err)
+	}
+	return &config.Secret{
+		ResourceName: resourceName,
+		FileName:     fileName,
+		Reference:    ref,
+	}
+}
+
+// fakeClient is an in-memory connect.Client. Only the methods used by the
+// provider are implemented, calling any other method panics.
+type fakeClient struct {
+	connect.Client
+	vaults []onepassword.Vault
+	items  []*onepassword.Item
+}
+
+func newFakeClient(items ...*onepassword.Item) *fakeClient {
+	return &fakeClient{
+		vaults: []onepassword.Vault{{ID: testVaultID, Name: "Production"}},
+		items:  items,
 	}
+}
+
+// newFakeBackend returns a Connect backend serving items from a fakeClient.
+func newFakeBackend(items ...*onepassword.Item) Backend {
+	return NewConnectBackend(newFakeClient(items...))
+}
 
-	t.Cleanup(shutdown)
-	return client
+func (c *fakeClient) vaultID(query string) (string, error) {
+	for _, v := range c.vaults {
+		if v.ID == query || v.Name == query {
+			return v.ID, nil
+		}
+	}
+	return "", &onepassword.Error{StatusCode: 404, Message: fmt.Sprintf("vault %s not found", query)}
 }
 
-// mockSecretServer matches the secremanagerpb.SecretManagerServiceServer
-// interface and allows the AccessSecretVersion implementation to be stubbed
-// with the accessFn function.
-type mockSecretServer struct {
-	secretmanagerpb.UnimplementedSecretManagerServiceServer
-	accessFn func(context.Context, *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error)
+func (c *fakeClient) GetVaults() ([]onepassword.Vault, error) {
+	return c.vaults, nil
 }
 
-func (s *mockSecretServer) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
-	if s.accessFn == nil {
-		return nil, status.Error(codes.Unimplemented, "mock does not implement accessFn")
+func (c *fakeClient) GetVaultsByTitle(title string) ([]onepassword.Vault, error) {
+	var out []onepassword.Vault
+	for _, v := range c.vaults {
+		if v.Name == title {
+			out = append(out, v)
+		}
 	}
-	return s.accessFn(ctx, req)
+	return out, nil
 }
 
-// fakeCreds will adhere to the credentials.PerRPCCredentials interface to add
-// empty credentials on a per-rpc basis.
-type fakeCreds struct{}
+func (c *fakeClient) GetItemByUUID(uuid, vaultQuery string) (*onepassword.Item, error) {
+	vaultID, err := c.vaultID(vaultQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range c.items {
+		if item.Vault.ID == vaultID && item.ID == uuid {
+			return item, nil
+		}
+	}
+	return nil, &onepassword.Error{StatusCode: 404, Message: fmt.Sprintf("item %s not found", uuid)}
+}
 
-func NewFakeCreds() fakeCreds {
-	return fakeCreds{}
+func (c *fakeClient) GetItemsByTitle(title, vaultQuery string) ([]onepassword.Item, error) {
+	vaultID, err := c.vaultID(vaultQuery)
+	if err != nil {
+		return nil, err
+	}
+	var out []onepassword.Item
+	for _, item := range c.items {
+		if item.Vault.ID == vaultID && item.Title == title {
+			out = append(out, *item)
+		}
+	}
+	return out, nil
 }
 
-// GetRequestMetadata gets the request metadata as a map from a TokenSource.
-func (f fakeCreds) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
-	return map[string]string{
-		"authorization": "fake",
-	}, nil
+func (c *fakeClient) GetFiles(itemQuery, vaultQuery string) ([]onepassword.File, error) {
+	item, err := c.GetItemByUUID(itemQuery, vaultQuery)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]onepassword.File, 0, len(item.Files))
+	for _, f := range item.Files {
+		files = append(files, *f)
+	}
+	return files, nil
 }
 
-// RequireTransportSecurity indicates whether the credentials requires transport security.
-// Since these are fake credentials for use with mock local server this is set to false.
-func (f fakeCreds) RequireTransportSecurity() bool {
-	return false
+func (c *fakeClient) GetFileContent(file *onepassword.File) ([]byte, error) {
+	return file.Content()
 }
 
-*/
+// testRegistry returns a profile registry serving clients, with "default" as
+// the default profile.
+func testRegistry(t *testing.T, clients map[string]connect.Client) *profiles.Registry {
+	t.Helper()
+	r := profiles.NewRegistry("default", "test")
+	for name, c := range clients {
+		if err := r.Register(name, &profiles.Profile{URL: "http://connect.invalid"}, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+// connectStub is a Connect server serving the vaults and items of a
+// fakeClient over HTTP. It records the Authorization headers it receives.
+type connectStub struct {
+	*httptest.Server
+	mu   sync.Mutex
+	auth []string
+}
+
+func newConnectStub(t *testing.T, client *fakeClient) *connectStub {
+	t.Helper()
+	stub := &connectStub{}
+	writeJSON := func(w http.ResponseWriter, v interface{}, err error) {
+		if err != nil {
+			var opErr *onepassword.Error
+			if errors.As(err, &opErr) {
+				w.WriteHeader(opErr.StatusCode)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			json.NewEncoder(w).Encode(err)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}
+	title := func(r *http.Request) string {
+		f := r.URL.Query().Get("filter")
+		return strings.TrimSuffix(strings.TrimPrefix(f, `title eq "`), `"`)
+	}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.mu.Lock()
+		stub.auth = append(stub.auth, r.Header.Get("Authorization"))
+		stub.mu.Unlock()
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 2 && parts[1] == "vaults":
+			vaults, err := client.GetVaultsByTitle(title(r))
+			writeJSON(w, vaults, err)
+		case len(parts) == 4 && parts[3] == "items":
+			items, err := client.GetItemsByTitle(title(r), parts[2])
+			writeJSON(w, items, err)
+		case len(parts) == 5 && parts[3] == "items":
+			item, err := client.GetItemByUUID(parts[4], parts[2])
+			writeJSON(w, item, err)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// tokens returns the distinct Authorization headers received.
+func (s *connectStub) tokens() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	seen := make(map[string]bool)
+	for _, a := range s.auth {
+		if !seen[a] {
+			seen[a] = true
+			out = append(out, a)
+		}
+	}
+	return out
+}
@@ -0,0 +1,191 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"golang.org/x/sync/singleflight"
+)
+
+// snapshotBackend shares the lookups of the secrets of a single mount. Every
+// vault title, item, file list and file is fetched at most once per mount, so
+// secrets referencing different fields of the same item cost a single item
+// lookup. Items are also shared between lookups by ID and by title, so all
+// files of a mount are derived from the same version of each item and a
+// rotation never mixes an old username with a new password.
+type snapshotBackend struct {
+	Backend
+	group singleflight.Group
+
+	mu      sync.Mutex
+	results map[string]interface{}
+	// items holds the first version of every item seen, by vault and item
+	// ID.
+	items map[string]*onepassword.Item
+}
+
+// newSnapshot returns b with its lookups shared for the duration of a mount.
+// The scope of b is not kept, see keepScope.
+func newSnapshot(b Backend) *snapshotBackend {
+	return &snapshotBackend{
+		Backend: b,
+		results: make(map[string]interface{}),
+		items:   make(map[string]*onepassword.Item),
+	}
+}
+
+// get returns the result of the earlier call for key or calls fetch, sharing
+// the call with concurrent callers. Errors are not kept; the mount fails
+// anyway. Results of earlier or concurrent calls are marked as cached in ctx.
+func (b *snapshotBackend) get(ctx context.Context, key string, fetch func() (interface{}, error)) (interface{}, error) {
+	b.mu.Lock()
+	v, ok := b.results[key]
+	b.mu.Unlock()
+	if ok {
+		markCached(ctx)
+		return v, nil
+	}
+	fetched := false
+	v, err, _ := b.group.Do(key, func() (interface{}, error) {
+		fetched = true
+		v, err := fetch()
+		if err == nil {
+			b.mu.Lock()
+			b.results[key] = v
+			b.mu.Unlock()
+		}
+		return v, err
+	})
+	if !fetched {
+		markCached(ctx)
+	}
+	return v, err
+}
+
+// item returns the version of item the mount saw first.
+func (b *snapshotBackend) item(vaultID string, item *onepassword.Item) *onepassword.Item {
+	key := fmt.Sprintf("%q", []string{vaultID, item.ID})
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seen, ok := b.items[key]; ok {
+		return seen
+	}
+	b.items[key] = item
+	return item
+}
+
+// seen returns the items the mount looked up, by vault and item ID.
+func (b *snapshotBackend) seen() []*onepassword.Item {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(b.items))
+	for key := range b.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	items := make([]*onepassword.Item, len(keys))
+	for i, key := range keys {
+		items[i] = b.items[key]
+	}
+	return items
+}
+
+func (b *snapshotBackend) FindVaults(ctx context.Context, title string) ([]onepassword.Vault, error) {
+	v, err := b.get(ctx, fmt.Sprintf("vaults\x00%q", title), func() (interface{}, error) {
+		return b.Backend.FindVaults(ctx, title)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]onepassword.Vault), nil
+}
+
+func (b *snapshotBackend) GetItem(ctx context.Context, vaultID, itemID string) (*onepassword.Item, error) {
+	b.mu.Lock()
+	seen, ok := b.items[fmt.Sprintf("%q", []string{vaultID, itemID})]
+	b.mu.Unlock()
+	if ok {
+		markCached(ctx)
+		return seen, nil
+	}
+	v, err := b.get(ctx, fmt.Sprintf("item\x00%q", []string{vaultID, itemID}), func() (interface{}, error) {
+		item, err := b.Backend.GetItem(ctx, vaultID, itemID)
+		if err != nil {
+			return nil, err
+		}
+		return b.item(vaultID, item), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*onepassword.Item), nil
+}
+
+func (b *snapshotBackend) FindItems(ctx context.Context, vaultID, title string) ([]onepassword.Item, error) {
+	v, err := b.get(ctx, fmt.Sprintf("items\x00%q", []string{vaultID, title}), func() (interface{}, error) {
+		items, err := b.Backend.FindItems(ctx, vaultID, title)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]onepassword.Item, len(items))
+		for i := range items {
+			out[i] = *b.item(vaultID, &items[i])
+		}
+		return out, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]onepassword.Item), nil
+}
+
+// ListFiles returns the files of the item the mount saw if it lists any, so
+// that they belong to the same version as its fields and cost no further
+// call. Only items without files are asked for again.
+func (b *snapshotBackend) ListFiles(ctx context.Context, vaultID, itemID string) ([]onepassword.File, error) {
+	b.mu.Lock()
+	seen, ok := b.items[fmt.Sprintf("%q", []string{vaultID, itemID})]
+	b.mu.Unlock()
+	if ok && len(seen.Files) > 0 {
+		files := make([]onepassword.File, len(seen.Files))
+		for i, f := range seen.Files {
+			files[i] = *f
+		}
+		markCached(ctx)
+		return files, nil
+	}
+	v, err := b.get(ctx, fmt.Sprintf("files\x00%q", []string{vaultID, itemID}), func() (interface{}, error) {
+		return b.Backend.ListFiles(ctx, vaultID, itemID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]onepassword.File), nil
+}
+
+func (b *snapshotBackend) GetFileContent(ctx context.Context, vaultID, itemID string, file *onepassword.File) ([]byte, error) {
+	v, err := b.get(ctx, fmt.Sprintf("content\x00%q", []string{vaultID, itemID, file.ID}), func() (interface{}, error) {
+		return b.Backend.GetFileContent(ctx, vaultID, itemID, file)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+)
+
+func TestHandleMountEventSnapshot(t *testing.T) {
+	b := &testBackend{Backend: newFakeBackend(testItem()), editing: true}
+	cfg := &config.MountConfig{
+		Secrets: []*config.Secret{
+			secret(t, "op://Production/Postgres/username", "username"),
+			secret(t, "op://Production/Postgres/password", "password"),
+			secret(t, "op://Production/Postgres", "item.json"),
+			secret(t, "op://"+testVaultID+"/"+testItemID+"/password", "password-by-id"),
+			secret(t, "op://Production/Postgres/ca.pem", "ca.pem"),
+		},
+		Permissions: 777,
+		PodInfo:     &config.PodInfo{Namespace: "default", Name: "test-pod"},
+	}
+
+	resp, err := (&Server{}).handleMountEvent(context.Background(), b, cfg)
+	if err != nil {
+		t.Fatalf("handleMountEvent() failed: %v", err)
+	}
+	if n := b.count("find_items"); n != 1 {
+		t.Errorf("item looked up by title %d times, want 1", n)
+	}
+	if n := b.count("get_item"); n > 1 {
+		t.Errorf("item looked up by ID %d times, want at most 1", n)
+	}
+	if n := b.count("list_files"); n != 0 {
+		t.Errorf("files listed %d times, want them taken from the item", n)
+	}
+
+	contents := make(map[string]string)
+	for _, f := range resp.GetFiles() {
+		contents[f.GetPath()] = string(f.GetContents())
+	}
+	if contents["password"] != contents["password-by-id"] {
+		t.Errorf("secrets of the same item saw different versions: password %q, password-by-id %q", contents["password"], contents["password-by-id"])
+	}
+	if want := "ca-" + strings.TrimPrefix(contents["password"], "password-"); contents["ca.pem"] != want {
+		t.Errorf("file of the item saw a different version: ca.pem %q, want %q", contents["ca.pem"], want)
+	}
+}
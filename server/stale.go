@@ -0,0 +1,254 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"k8s.io/klog/v2"
+)
+
+// staleVersionSuffix marks the object versions of secrets mounted from stale
+// data.
+const staleVersionSuffix = "-stale"
+
+var staleServes, _ = meter.Int64Counter("onepassword.stale.serves",
+	metric.WithDescription("Vault and item lookups answered with stale data because the backend was unavailable, by operation."))
+
+// StaleStore keeps the results of vault and item lookups so they can be
+// served for a limited time while the backend is unavailable. Results are
+// encrypted with a key generated at startup so they do not show up in plain
+// text in heap dumps. Entries are keyed by the credentials of the backend like
+// the entries of a Cache.
+type StaleStore struct {
+	window time.Duration
+	aead   cipher.AEAD
+
+	mu        sync.Mutex
+	entries   map[string]*staleEntry
+	lastSweep time.Time
+
+	// clock returns the current time, time.Now if nil.
+	clock func() time.Time
+}
+
+type staleEntry struct {
+	stored time.Time
+	nonce  []byte
+	data   []byte
+}
+
+// NewStaleStore returns a StaleStore serving results for up to window after
+// they were last fetched from the backend.
+func NewStaleStore(window time.Duration) (*StaleStore, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("unable to generate key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &StaleStore{
+		window:  window,
+		aead:    aead,
+		entries: make(map[string]*staleEntry),
+	}, nil
+}
+
+func (s *StaleStore) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
+
+// backend returns b with its vault and item lookups recorded in and, while b
+// is unavailable, answered from the store. It returns nil if b cannot name
+// its credentials.
+func (s *StaleStore) backend(b Backend) *staleBackend {
+	sc, ok := b.(scoper)
+	if !ok {
+		return nil
+	}
+	return &staleBackend{Backend: b, store: s, scope: sc.Scope()}
+}
+
+func (s *StaleStore) put(key string, value interface{}) {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		klog.ErrorS(err, "unable to store result for stale serving")
+		return
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		klog.ErrorS(err, "unable to store result for stale serving")
+		return
+	}
+	e := &staleEntry{stored: s.now(), nonce: nonce, data: s.aead.Seal(nil, nonce, plain, []byte(key))}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = e
+	// Drop expired entries from time to time so items that are no longer
+	// mounted do not stay in memory.
+	if e.stored.Sub(s.lastSweep) >= s.window {
+		for k, old := range s.entries {
+			if e.stored.Sub(old.stored) > s.window {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = e.stored
+	}
+}
+
+// get decodes the entry for key into out and returns its age. It reports
+// false if there is no entry younger than the window.
+func (s *StaleStore) get(key string, out interface{}) (time.Duration, bool) {
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	s.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	age := s.now().Sub(e.stored)
+	if age > s.window {
+		return 0, false
+	}
+	plain, err := s.aead.Open(nil, e.nonce, e.data, []byte(key))
+	if err != nil {
+		klog.ErrorS(err, "unable to decrypt stale result")
+		return 0, false
+	}
+	if err := json.Unmarshal(plain, out); err != nil {
+		klog.ErrorS(err, "unable to decode stale result")
+		return 0, false
+	}
+	return age, true
+}
+
+// unavailable reports whether err means the backend could not be reached or
+// failed on its side, as opposed to rejecting the request.
+func unavailable(err error) bool {
+	if errors.Is(err, errCircuitOpen) {
+		return true
+	}
+	var opErr *onepassword.Error
+	if errors.As(err, &opErr) {
+		return opErr.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	return errors.As(err, &netErr) || errors.As(err, &urlErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// staleBackend records the vault and item lookups of a Backend in a
+// StaleStore and answers them from the store while the backend is
+// unavailable. It is used for a single secret of a mount and remembers
+// whether any stale data was served and which items.
+type staleBackend struct {
+	Backend
+	store  *StaleStore
+	scope  string
+	served atomic.Bool
+	// items are the items served from the store.
+	items []*onepassword.Item
+}
+
+// lookup runs fetch and records its result in out, or falls back to the
+// stored result if the backend is unavailable. It reports whether out was
+// served from the store. Only results fetched from the backend are stored;
+// results from a cache are as old as the lookup that filled it, so storing
+// them again would extend the window past the last successful fetch.
+func (b *staleBackend) lookup(ctx context.Context, op string, out interface{}, fetch func(ctx context.Context) (interface{}, error), parts ...string) (bool, error) {
+	key := fmt.Sprintf("%s\x00%s\x00%q", b.scope, op, parts)
+	cached := false
+	v, err := fetch(withCachedMark(ctx, &cached))
+	if err == nil {
+		if !cached {
+			b.store.put(key, v)
+		}
+		// Round-trip through JSON like stale results so callers always see
+		// the same representation.
+		data, merr := json.Marshal(v)
+		if merr != nil {
+			return false, merr
+		}
+		return false, json.Unmarshal(data, out)
+	}
+	// Only failures of the backend fall back, not the end of the mount.
+	if !unavailable(err) || ctx.Err() != nil {
+		return false, err
+	}
+	age, ok := b.store.get(key, out)
+	if !ok {
+		return false, err
+	}
+	b.served.Store(true)
+	staleServes.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", op)))
+	klog.ErrorS(err, "backend unavailable, serving stale data", "operation", op, "item", parts, "age", age.Round(time.Second))
+	return true, nil
+}
+
+func (b *staleBackend) FindVaults(ctx context.Context, title string) ([]onepassword.Vault, error) {
+	var vaults []onepassword.Vault
+	_, err := b.lookup(ctx, "find_vaults", &vaults, func(ctx context.Context) (interface{}, error) {
+		return b.Backend.FindVaults(ctx, title)
+	}, title)
+	return vaults, err
+}
+
+func (b *staleBackend) GetItem(ctx context.Context, vaultID, itemID string) (*onepassword.Item, error) {
+	var item *onepassword.Item
+	stale, err := b.lookup(ctx, "get_item", &item, func(ctx context.Context) (interface{}, error) {
+		return b.Backend.GetItem(ctx, vaultID, itemID)
+	}, vaultID, itemID)
+	if stale {
+		b.items = append(b.items, item)
+	}
+	return item, err
+}
+
+func (b *staleBackend) FindItems(ctx context.Context, vaultID, title string) ([]onepassword.Item, error) {
+	var items []onepassword.Item
+	stale, err := b.lookup(ctx, "find_items", &items, func(ctx context.Context) (interface{}, error) {
+		return b.Backend.FindItems(ctx, vaultID, title)
+	}, vaultID, title)
+	if stale {
+		for i := range items {
+			b.items = append(b.items, &items[i])
+		}
+	}
+	return items, err
+}
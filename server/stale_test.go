@@ -0,0 +1,175 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/google/go-cmp/cmp"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "server error", err: &onepassword.Error{StatusCode: http.StatusBadGateway}, want: true},
+		{name: "not found", err: &onepassword.Error{StatusCode: http.StatusNotFound}},
+		{name: "unauthorized", err: &onepassword.Error{StatusCode: http.StatusUnauthorized}},
+		{name: "rate limited", err: &onepassword.Error{StatusCode: http.StatusTooManyRequests}},
+		{name: "connection refused", err: &url.Error{Op: "Get", URL: "http://connect:8080", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, want: true},
+		{name: "deadline", err: fmt.Errorf("op item: %w", context.DeadlineExceeded), want: true},
+		{name: "other", err: errors.New("decoding output")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := unavailable(tc.err); got != tc.want {
+				t.Errorf("unavailable(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStaleStore(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store, err := NewStaleStore(time.Hour)
+	if err != nil {
+		t.Fatalf("NewStaleStore() failed: %v", err)
+	}
+	store.clock = func() time.Time { return now }
+	team := &testBackend{Backend: newFakeBackend(testItem()), scope: "team"}
+	other := &testBackend{Backend: newFakeBackend(testItem()), scope: "other"}
+
+	fresh, err := store.backend(team).GetItem(context.Background(), testVaultID, testItemID)
+	if err != nil {
+		t.Fatalf("GetItem() failed: %v", err)
+	}
+	for _, e := range store.entries {
+		if strings.Contains(string(e.data), testItem().Fields[1].Value) {
+			t.Errorf("stored entry contains the item in plain text")
+		}
+	}
+
+	serves := metricValue(t, "onepassword.stale.serves", attribute.String("operation", "get_item"))
+	team.fail(&onepassword.Error{StatusCode: http.StatusServiceUnavailable})
+	other.fail(&onepassword.Error{StatusCode: http.StatusServiceUnavailable})
+	now = now.Add(30 * time.Minute)
+	b := store.backend(team)
+	got, err := b.GetItem(context.Background(), testVaultID, testItemID)
+	if err != nil {
+		t.Fatalf("GetItem() while unavailable failed: %v", err)
+	}
+	if diff := cmp.Diff(fresh, got); diff != "" {
+		t.Errorf("GetItem() returned unexpected stale item (-want +got):\n%s", diff)
+	}
+	if !b.served.Load() {
+		t.Errorf("stale serve was not recorded")
+	}
+	if got := metricValue(t, "onepassword.stale.serves", attribute.String("operation", "get_item")); got != serves+1 {
+		t.Errorf("stale serves = %d, want %d", got, serves+1)
+	}
+
+	// Other credentials never see the entries of team.
+	if _, err := store.backend(other).GetItem(context.Background(), testVaultID, testItemID); err == nil {
+		t.Errorf("GetItem() with other credentials succeeded, want error")
+	}
+
+	// Errors other than unavailability are returned.
+	team.fail(&onepassword.Error{StatusCode: http.StatusNotFound})
+	if _, err := store.backend(team).GetItem(context.Background(), testVaultID, testItemID); err == nil {
+		t.Errorf("GetItem() of a missing item succeeded, want error")
+	}
+
+	// Data older than the window is not served.
+	team.fail(&onepassword.Error{StatusCode: http.StatusServiceUnavailable})
+	now = now.Add(31 * time.Minute)
+	if _, err := store.backend(team).GetItem(context.Background(), testVaultID, testItemID); err == nil {
+		t.Errorf("GetItem() with expired data succeeded, want error")
+	}
+}
+
+func TestStaleStoreCacheHits(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	store, err := NewStaleStore(time.Hour)
+	if err != nil {
+		t.Fatalf("NewStaleStore() failed: %v", err)
+	}
+	store.clock = clock
+	cache := NewCache(time.Hour, 10)
+	cache.clock = clock
+	team := &testBackend{Backend: newFakeBackend(testItem()), scope: "team"}
+
+	if _, err := store.backend(cache.Backend(team)).GetItem(context.Background(), testVaultID, testItemID); err != nil {
+		t.Fatalf("GetItem() failed: %v", err)
+	}
+	// Cache hits do not make the stored result younger.
+	now = now.Add(50 * time.Minute)
+	if _, err := store.backend(cache.Backend(team)).GetItem(context.Background(), testVaultID, testItemID); err != nil {
+		t.Fatalf("GetItem() from the cache failed: %v", err)
+	}
+
+	team.fail(&onepassword.Error{StatusCode: http.StatusServiceUnavailable})
+	now = now.Add(20 * time.Minute)
+	if _, err := store.backend(cache.Backend(team)).GetItem(context.Background(), testVaultID, testItemID); err == nil {
+		t.Errorf("GetItem() with data fetched 70 minutes ago succeeded, want error")
+	}
+}
+
+func TestHandleMountEventStale(t *testing.T) {
+	store, err := NewStaleStore(time.Hour)
+	if err != nil {
+		t.Fatalf("NewStaleStore() failed: %v", err)
+	}
+	s := &Server{Stale: store}
+	backend := &testBackend{Backend: newFakeBackend(testItem()), scope: "team"}
+	cfg := &config.MountConfig{
+		Secrets: []*config.Secret{
+			secret(t, "op://Production/Postgres/password", "password"),
+		},
+		Permissions: 777,
+		PodInfo:     &config.PodInfo{Namespace: "default", Name: "test-pod"},
+	}
+
+	fresh, err := s.handleMountEvent(context.Background(), backend, cfg)
+	if err != nil {
+		t.Fatalf("handleMountEvent() failed: %v", err)
+	}
+	backend.fail(&onepassword.Error{StatusCode: http.StatusInternalServerError})
+	stale, err := s.handleMountEvent(context.Background(), backend, cfg)
+	if err != nil {
+		t.Fatalf("handleMountEvent() while unavailable failed: %v", err)
+	}
+
+	if diff := cmp.Diff(string(fresh.GetFiles()[0].GetContents()), string(stale.GetFiles()[0].GetContents())); diff != "" {
+		t.Errorf("stale mount returned unexpected contents (-want +got):\n%s", diff)
+	}
+	want := fresh.GetObjectVersion()[0].GetVersion() + staleVersionSuffix
+	if got := stale.GetObjectVersion()[0].GetVersion(); got != want {
+		t.Errorf("stale object version = %q, want %q", got, want)
+	}
+}
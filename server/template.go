@@ -0,0 +1,182 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// templateFuncs are the functions available to templates in addition to the
+// text/template builtins. None of them have side effects or access anything
+// outside their arguments.
+var templateFuncs = template.FuncMap{
+	"b64enc": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"b64dec": func(s string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("b64dec: %v", err)
+		}
+		return string(b), nil
+	},
+	"quote": strconv.Quote,
+	"trim":  strings.TrimSpace,
+	"join": func(sep string, elems ...string) string {
+		return strings.Join(elems, sep)
+	},
+	// default returns def if the value is empty. The value is the last
+	// argument so it can be piped: {{ .port | default "5432" }}.
+	"default": func(def string, value ...string) string {
+		if len(value) == 0 || value[len(value)-1] == "" {
+			return def
+		}
+		return value[len(value)-1]
+	},
+}
+
+// renderTemplate fetches the refs of secret and renders its template with
+// them.
+func (s *Server) renderTemplate(ctx context.Context, client Backend, secret *config.Secret) (*secretResult, error) {
+	tmpl, err := template.New(secret.PathString()).Option("missingkey=error").Funcs(templateFuncs).Parse(secret.Template)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid template: %v", err)
+	}
+	if err := checkTemplate(tmpl.Tree.Root, false); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid template: %v", err)
+	}
+
+	names := make([]string, 0, len(secret.TemplateRefs))
+	for name := range secret.TemplateRefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := make(map[string]string, len(names))
+	for _, name := range names {
+		ref := secret.TemplateRefs[name]
+		vaultID, err := resolveVault(ctx, client, ref.Vault, secret.MatchBy)
+		if err != nil {
+			return nil, err
+		}
+		item, err := resolveItem(ctx, client, vaultID, ref.Item, secret.MatchBy)
+		if err != nil {
+			return nil, err
+		}
+		value, _, err := s.fetchField(ctx, client, vaultID, item, ref)
+		if err != nil {
+			return nil, err
+		}
+		data[name] = string(value)
+	}
+
+	var b bytes.Buffer
+	w := &limitWriter{w: &b, limit: s.MaxFileSize}
+	if err := tmpl.Execute(w, data); err != nil {
+		if w.exceeded {
+			return nil, status.Errorf(codes.FailedPrecondition, "rendered template exceeds the limit of %d bytes", s.MaxFileSize)
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "unable to render template: %v", err)
+	}
+	return singleFile(b.Bytes(), s.renderedVersion(b.Bytes())), nil
+}
+
+// checkTemplate rejects templates whose execution is not bounded by their size
+// and the number of their refs, so that a template cannot keep the provider
+// busy without writing anything: range is only allowed over the refs or a
+// ref, ranges cannot be nested, and templates cannot call other templates,
+// which could recurse.
+func checkTemplate(node parse.Node, inRange bool) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkTemplate(child, inRange); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return checkBranch(&n.BranchNode, inRange)
+	case *parse.WithNode:
+		return checkBranch(&n.BranchNode, inRange)
+	case *parse.RangeNode:
+		if inRange {
+			return fmt.Errorf("line %d: nested range is not supported", n.Line)
+		}
+		cmds := n.Pipe.Cmds
+		if len(cmds) != 1 || len(cmds[0].Args) != 1 {
+			return fmt.Errorf("line %d: range is only supported over . or a ref", n.Line)
+		}
+		switch cmds[0].Args[0].(type) {
+		case *parse.DotNode, *parse.FieldNode:
+		default:
+			return fmt.Errorf("line %d: range is only supported over . or a ref", n.Line)
+		}
+		if err := checkTemplate(n.List, true); err != nil {
+			return err
+		}
+		return checkTemplate(n.ElseList, inRange)
+	case *parse.TemplateNode:
+		return fmt.Errorf("line %d: calling templates is not supported", n.Line)
+	}
+	return nil
+}
+
+func checkBranch(n *parse.BranchNode, inRange bool) error {
+	if err := checkTemplate(n.List, inRange); err != nil {
+		return err
+	}
+	return checkTemplate(n.ElseList, inRange)
+}
+
+// errLimitExceeded stops the execution of templates whose output exceeds
+// the file size limit.
+var errLimitExceeded = errors.New("output exceeds the size limit")
+
+// limitWriter writes to w until limit bytes were written and fails after, so
+// that templates cannot render files of unbounded size. A limit of zero or
+// less means no limit.
+type limitWriter struct {
+	w        io.Writer
+	limit    int64
+	written  int64
+	exceeded bool
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.limit > 0 && l.written+int64(len(p)) > l.limit {
+		l.exceeded = true
+		return 0, errLimitExceeded
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
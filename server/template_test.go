@@ -0,0 +1,177 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"github.com/google/go-cmp/cmp"
+	"github.com/meisterlabs/secrets-store-csi-driver-provider-1password/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func templateSecret(t *testing.T, tmpl string, refs map[string]string) *config.Secret {
+	t.Helper()
+	s := &config.Secret{Path: "out", Template: tmpl, Refs: refs}
+	s.TemplateRefs = make(map[string]*config.Reference, len(refs))
+	for name, r := range refs {
+		ref, err := config.ParseReference(r)
+		if err != nil {
+			t.Fatalf("ParseReference(%q) failed: %v", r, err)
+		}
+		s.TemplateRefs[name] = ref
+	}
+	return s
+}
+
+func TestRenderTemplate(t *testing.T) {
+	cache := &onepassword.Item{
+		ID:    "ws3h5d7xsgxg5djcmdyq2ihjlu",
+		Title: "Redis",
+		Vault: onepassword.ItemVault{ID: testVaultID},
+		Fields: []*onepassword.ItemField{
+			{ID: "password", Label: "password", Value: "c2VjcmV0"},
+		},
+	}
+	client := newFakeBackend(testItem(), cache)
+	refs := map[string]string{
+		"user":  "op://Production/Postgres/username",
+		"pass":  "op://Production/Postgres/password",
+		"host":  "op://Production/Postgres/replica/host",
+		"redis": "op://Production/Redis/password",
+	}
+
+	tests := []struct {
+		name     string
+		tmpl     string
+		refs     map[string]string
+		want     string
+		wantCode codes.Code
+	}{
+		{
+			name: "multiple items",
+			tmpl: "jdbc:postgresql://{{ .host }}/app?user={{ .user }}&password={{ .pass }}\nredis={{ .redis | b64dec }}",
+			refs: refs,
+			want: "jdbc:postgresql://db-1.internal/app?user=admin&password=hunter2\nredis=secret",
+		},
+		{
+			name: "functions",
+			tmpl: `{{ join ":" .user .pass | b64enc }} {{ quote .host }} {{ trim "  x " }} {{ "" | default "5432" }}`,
+			refs: map[string]string{"user": refs["user"], "pass": refs["pass"], "host": refs["host"]},
+			want: `YWRtaW46aHVudGVyMg== "db-1.internal" x 5432`,
+		},
+		{
+			name:     "missing field",
+			tmpl:     "{{ .port }}",
+			refs:     map[string]string{"port": "op://Production/Postgres/port"},
+			wantCode: codes.NotFound,
+		},
+		{
+			name:     "undefined name",
+			tmpl:     "{{ .other }}",
+			refs:     map[string]string{"user": refs["user"]},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "syntax error",
+			tmpl:     "{{ .user ",
+			refs:     map[string]string{"user": refs["user"]},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "unknown function",
+			tmpl:     `{{ env "HOME" }}`,
+			refs:     map[string]string{"user": refs["user"]},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			got, err := s.renderTemplate(context.Background(), client, templateSecret(t, tc.tmpl, tc.refs))
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("renderTemplate() got code %v, want %v (err = %v)", code, tc.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(tc.want, string(got.files[0].data)); diff != "" {
+				t.Errorf("renderTemplate() returned unexpected content (-want +got):\n%s", diff)
+			}
+			if got.version != s.renderedVersion(got.files[0].data) {
+				t.Errorf("renderTemplate() version = %q, want %q", got.version, s.renderedVersion(got.files[0].data))
+			}
+		})
+	}
+}
+
+func TestRenderTemplateSizeLimit(t *testing.T) {
+	client := newFakeBackend(testItem())
+	refs := map[string]string{"pass": "op://Production/Postgres/password"}
+	s := &Server{MaxFileSize: 1024}
+
+	large := strings.Repeat("{{ .pass }}", 147)
+	_, err := s.renderTemplate(context.Background(), client, templateSecret(t, large, refs))
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("renderTemplate() of 1029 bytes got code %v, want %v (err = %v)", code, codes.FailedPrecondition, err)
+	}
+
+	got, err := s.renderTemplate(context.Background(), client, templateSecret(t, strings.Repeat("{{ .pass }}", 128), refs))
+	if err != nil {
+		t.Fatalf("renderTemplate() of 896 bytes with a limit of 1024 failed: %v", err)
+	}
+	if len(got.files[0].data) != 896 {
+		t.Errorf("renderTemplate() rendered %d bytes, want 896", len(got.files[0].data))
+	}
+}
+
+func TestRenderTemplateUnbounded(t *testing.T) {
+	client := newFakeBackend(testItem())
+	refs := map[string]string{"user": "op://Production/Postgres/username", "pass": "op://Production/Postgres/password"}
+
+	tests := []struct {
+		name string
+		tmpl string
+	}{
+		// Loops forever without writing a byte, so the size limit never
+		// stops it.
+		{name: "range over integer", tmpl: "{{ range 100000000000 }}{{ end }}"},
+		{name: "range over variable", tmpl: "{{ $n := 100000000000 }}{{ range $n }}{{ end }}"},
+		{name: "range over function", tmpl: `{{ range (join "," .user .pass) }}{{ end }}`},
+		{name: "nested range", tmpl: "{{ range . }}{{ with $ }}{{ range . }}{{ end }}{{ end }}{{ end }}"},
+		{name: "recursion", tmpl: `{{ define "a" }}{{ template "a" . }}{{ template "a" . }}{{ end }}{{ template "a" . }}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := (&Server{}).renderTemplate(context.Background(), client, templateSecret(t, tc.tmpl, refs))
+			if code := status.Code(err); code != codes.InvalidArgument {
+				t.Errorf("renderTemplate() got code %v, want %v (err = %v)", code, codes.InvalidArgument, err)
+			}
+		})
+	}
+
+	got, err := (&Server{}).renderTemplate(context.Background(), client, templateSecret(t, "{{ range $name, $value := . }}{{ $name }}={{ $value }}\n{{ end }}", refs))
+	if err != nil {
+		t.Fatalf("renderTemplate() of a range over the refs failed: %v", err)
+	}
+	if want := "pass=hunter2\nuser=admin\n"; string(got.files[0].data) != want {
+		t.Errorf("renderTemplate() = %q, want %q", got.files[0].data, want)
+	}
+}
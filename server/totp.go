@@ -0,0 +1,135 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// totpParams are the parameters of a time-based one-time password as encoded
+// in an otpauth:// URI.
+type totpParams struct {
+	secret    []byte
+	algorithm func() hash.Hash
+	digits    int
+	period    int64
+}
+
+// parseTOTP parses the value of an OTP field, either an otpauth://totp/ URI or
+// a bare base32 secret using the defaults of RFC 6238 (SHA1, 6 digits, 30
+// seconds).
+func parseTOTP(value string) (*totpParams, error) {
+	p := &totpParams{algorithm: sha1.New, digits: 6, period: 30}
+	secret := value
+	if strings.HasPrefix(value, "otpauth:") {
+		u, err := url.Parse(value)
+		if err != nil {
+			// The error of url.Parse quotes the URI, secret included.
+			return nil, errors.New("invalid otpauth URI")
+		}
+		if u.Host != "totp" {
+			return nil, fmt.Errorf("unsupported one-time password type %q, only totp is supported", u.Host)
+		}
+		q := u.Query()
+		secret = q.Get("secret")
+		switch strings.ToUpper(q.Get("algorithm")) {
+		case "", "SHA1":
+		case "SHA256":
+			p.algorithm = sha256.New
+		case "SHA512":
+			p.algorithm = sha512.New
+		default:
+			return nil, fmt.Errorf("unsupported algorithm %q", q.Get("algorithm"))
+		}
+		if d := q.Get("digits"); d != "" {
+			n, err := strconv.Atoi(d)
+			if err != nil || n < 6 || n > 8 {
+				return nil, fmt.Errorf("invalid digits %q, must be between 6 and 8", d)
+			}
+			p.digits = n
+		}
+		if s := q.Get("period"); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid period %q", s)
+			}
+			p.period = n
+		}
+	}
+
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	if secret == "" {
+		return nil, fmt.Errorf("missing secret")
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base32 secret: %v", err)
+	}
+	p.secret = key
+	return p, nil
+}
+
+// step returns the time step of t.
+func (p *totpParams) step(t time.Time) int64 {
+	return t.Unix() / p.period
+}
+
+// code returns the one-time password of the given time step as described in
+// RFC 6238 and RFC 4226.
+func (p *totpParams) code(step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(p.algorithm, p.secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < p.digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", p.digits, bin%mod)
+}
+
+// totpCode returns the current one-time password of an OTP field and its time
+// step.
+func (s *Server) totpCode(item *onepassword.Item, field *onepassword.ItemField) (string, int64, error) {
+	if field.Type != onepassword.FieldTypeOTP {
+		return "", 0, status.Errorf(codes.FailedPrecondition, "field %s of item %s is not a one-time password", field.ID, item.ID)
+	}
+	p, err := parseTOTP(field.Value)
+	if err != nil {
+		return "", 0, status.Errorf(codes.FailedPrecondition, "one-time password %s of item %s: %v", field.ID, item.ID, err)
+	}
+	step := p.step(s.now())
+	return p.code(step), step, nil
+}
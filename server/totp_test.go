@@ -0,0 +1,105 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestTOTPCode uses the test vectors of RFC 6238 appendix B.
+func TestTOTPCode(t *testing.T) {
+	enc := base32.StdEncoding.EncodeToString
+	sha1Key := enc([]byte("12345678901234567890"))
+	sha256Key := enc([]byte("12345678901234567890123456789012"))
+	sha512Key := enc([]byte("1234567890123456789012345678901234567890123456789012345678901234"))
+
+	tests := []struct {
+		value string
+		time  int64
+		want  string
+	}{
+		{"otpauth://totp/x?secret=" + sha1Key + "&digits=8", 59, "94287082"},
+		{"otpauth://totp/x?secret=" + sha256Key + "&digits=8&algorithm=SHA256", 59, "46119246"},
+		{"otpauth://totp/x?secret=" + sha512Key + "&digits=8&algorithm=SHA512", 59, "90693936"},
+		{"otpauth://totp/x?secret=" + sha1Key + "&digits=8", 1111111109, "07081804"},
+		{"otpauth://totp/x?secret=" + sha256Key + "&digits=8&algorithm=sha256", 20000000000, "77737706"},
+		{"otpauth://totp/x?secret=" + sha1Key + "&digits=8&period=60", 118, "94287082"},
+		{"otpauth://totp/x?secret=" + sha1Key, 59, "287082"},
+		{sha1Key, 59, "287082"},
+	}
+	for _, tc := range tests {
+		p, err := parseTOTP(tc.value)
+		if err != nil {
+			t.Errorf("parseTOTP(%q) failed: %v", tc.value, err)
+			continue
+		}
+		if got := p.code(p.step(time.Unix(tc.time, 0))); got != tc.want {
+			t.Errorf("code of %q at %d = %q, want %q", tc.value, tc.time, got, tc.want)
+		}
+	}
+}
+
+func TestParseTOTPErrors(t *testing.T) {
+	for _, value := range []string{
+		"otpauth://hotp/x?secret=GEZDGNBVGY3TQOJQ&counter=1",
+		"otpauth://totp/x?secret=GEZDGNBVGY3TQOJQ&algorithm=MD5",
+		"otpauth://totp/x?secret=GEZDGNBVGY3TQOJQ&digits=4",
+		"otpauth://totp/x?secret=GEZDGNBVGY3TQOJQ&period=0",
+		"otpauth://totp/x",
+		"otpauth://%zz/x?secret=GEZDGNBVGY3TQOJQ",
+		"not base32!",
+	} {
+		_, err := parseTOTP(value)
+		if err == nil {
+			t.Errorf("parseTOTP(%q) succeeded, want error", value)
+			continue
+		}
+		if strings.Contains(err.Error(), "GEZDGNBVGY3TQOJQ") {
+			t.Errorf("parseTOTP(%q) error %q contains the secret", value, err)
+		}
+	}
+}
+
+func TestTOTPVersionChangesWithStep(t *testing.T) {
+	item := testItem()
+	field := item.Fields[4]
+	now := time.Unix(1700000000, 0)
+	s := &Server{clock: func() time.Time { return now }}
+
+	_, step1, err := s.totpCode(item, field)
+	if err != nil {
+		t.Fatalf("totpCode() failed: %v", err)
+	}
+	now = now.Add(30 * time.Second)
+	_, step2, err := s.totpCode(item, field)
+	if err != nil {
+		t.Fatalf("totpCode() failed: %v", err)
+	}
+	if s.totpVersion(item, field, step1) == s.totpVersion(item, field, step2) {
+		t.Errorf("totpVersion() did not change between time steps %d and %d", step1, step2)
+	}
+
+	_, _, err = s.totpCode(item, &onepassword.ItemField{ID: "password", Type: onepassword.FieldTypeConcealed})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("totpCode() of a non-OTP field got code %v, want %v", code, codes.FailedPrecondition)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/1Password/connect-sdk-go/connect"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1"
+)
+
+// mountSpans returns the spans of the trace of the mount of pod.
+func mountSpans(t *testing.T, pod string) []sdktrace.ReadOnlySpan {
+	t.Helper()
+	var root sdktrace.ReadOnlySpan
+	for _, s := range testSpans.Ended() {
+		if v, _ := attrValue(s.Attributes(), "k8s.pod.name"); s.Name() == "Server.Mount" && v == pod {
+			root = s
+		}
+	}
+	if root == nil {
+		t.Fatalf("no Server.Mount span of pod %s", pod)
+	}
+	var spans []sdktrace.ReadOnlySpan
+	for _, s := range testSpans.Ended() {
+		if s.SpanContext().TraceID() == root.SpanContext().TraceID() {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func TestMountTracing(t *testing.T) {
+	s := &Server{
+		Clients: testRegistry(t, map[string]connect.Client{"default": newFakeClient(), "tracing": newFakeClient(testItem())}),
+	}
+	_, err := s.Mount(context.Background(), &v1alpha1.MountRequest{
+		Attributes: `{"connect": "tracing", "secrets": "- resourceName: op://Production/Postgres/password\n  path: password\n- resourceName: op://Production/Postgres\n  path: item.json\n", "csi.storage.k8s.io/pod.namespace": "tracing", "csi.storage.k8s.io/pod.name": "trace-pod"}`,
+		Secrets:    "{}",
+		TargetPath: "/tmp",
+		Permission: "420",
+	})
+	if err != nil {
+		t.Fatalf("Mount() failed: %v", err)
+	}
+
+	spans := mountSpans(t, "trace-pod")
+	names := make(map[string]int)
+	byID := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		names[s.Name()]++
+		byID[s.SpanContext().SpanID().String()] = s
+	}
+	for name, want := range map[string]int{
+		"Server.Mount":            1,
+		"config.Parse":            1,
+		"fetch secret":            2,
+		"onepassword.find_vaults": 1,
+		"onepassword.find_items":  1,
+	} {
+		if names[name] != want {
+			t.Errorf("%d spans named %q, want %d (spans: %v)", names[name], name, want, names)
+		}
+	}
+
+	for _, s := range spans {
+		// Backend calls are part of the fetch of a secret.
+		if strings.HasPrefix(s.Name(), "onepassword.") {
+			if parent, ok := byID[s.Parent().SpanID().String()]; !ok || parent.Name() != "fetch secret" {
+				t.Errorf("span %s is not a child of a fetch secret span", s.Name())
+			}
+		}
+		if s.Name() == "Server.Mount" {
+			for key, want := range map[attribute.Key]string{"k8s.namespace.name": "tracing", "k8s.pod.name": "trace-pod"} {
+				if v, _ := attrValue(s.Attributes(), key); v != want {
+					t.Errorf("Server.Mount attribute %s = %q, want %q", key, v, want)
+				}
+			}
+		}
+
+		// Secret values never end up in spans.
+		attrs := append([]attribute.KeyValue{}, s.Attributes()...)
+		for _, e := range s.Events() {
+			attrs = append(attrs, e.Attributes...)
+		}
+		for _, kv := range attrs {
+			if strings.Contains(kv.Value.Emit(), "hunter2") {
+				t.Errorf("span %s attribute %s holds a secret value", s.Name(), kv.Key)
+			}
+		}
+	}
+}
+
+func attrValue(attrs []attribute.KeyValue, key attribute.Key) (string, bool) {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return kv.Value.Emit(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 MeisterLabs Gmbh
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"time"
+
+	"github.com/1Password/connect-sdk-go/onepassword"
+)
+
+// The object versions reported to the driver decide whether the rotation
+// reconciler rewrites a file, so they must change exactly when the mounted
+// content changes. They are published in SecretProviderClassPodStatus, which
+// is readable cluster-wide, so versions derived from content are keyed HMACs
+// that do not allow guessing short values offline.
+
+// versionMAC returns a new HMAC keyed with the VersionKey of s, or with a
+// random key chosen on first use if it has none.
+func (s *Server) versionMAC() hash.Hash {
+	s.versionOnce.Do(func() {
+		s.versionKey = s.VersionKey
+		if len(s.versionKey) == 0 {
+			s.versionKey = make([]byte, 32)
+			rand.Read(s.versionKey)
+		}
+	})
+	return hmac.New(sha256.New, s.versionKey)
+}
+
+// itemVersion is the object version of secrets that mount a whole item. It
+// changes with every edit of the item.
+func itemVersion(item *onepassword.Item) string {
+	return fmt.Sprintf("%d-%s", item.Version, item.UpdatedAt.UTC().Format(time.RFC3339Nano))
+}
+
+// contentVersion is the object version of secrets that mount a single field or
+// file. Edits to other parts of the item do not change it.
+func (s *Server) contentVersion(item *onepassword.Item, data []byte) string {
+	h := s.versionMAC()
+	h.Write([]byte(item.Vault.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(item.ID))
+	h.Write([]byte{0})
+	h.Write(data)
+	return "hmac-" + hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// totpVersion is the object version of a one-time password. It changes with
+// every time step so the rotation reconciler writes each new code.
+func (s *Server) totpVersion(item *onepassword.Item, field *onepassword.ItemField, step int64) string {
+	return s.contentVersion(item, []byte(field.ID+"\x00"+field.Value)) + "-" + strconv.FormatInt(step, 10)
+}
+
+// filesVersion is the object version of secrets that mount several files. It
+// covers the names and contents of all files.
+func (s *Server) filesVersion(item *onepassword.Item, files []resultFile) string {
+	h := sha256.New()
+	for _, f := range files {
+		h.Write([]byte(strconv.Itoa(len(f.path))))
+		h.Write([]byte(f.path))
+		h.Write([]byte(strconv.Itoa(len(f.data))))
+		h.Write(f.data)
+	}
+	return s.contentVersion(item, h.Sum(nil))
+}
+
+// renderedVersion is the object version of secrets rendered from several
+// items. It covers the rendered content.
+func (s *Server) renderedVersion(data []byte) string {
+	h := s.versionMAC()
+	h.Write(data)
+	return "hmac-" + hex.EncodeToString(h.Sum(nil))[:32]
+}